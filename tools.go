@@ -3,40 +3,138 @@
 package toolkit
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"maps"
+	"math"
+	"math/big"
 	"math/rand/v2"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 const randStringSource = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_+"
 
+// readableStringSource is the source of RandomReadableString: upper case letters and digits, without
+// those easily confused with one another, such as 0 and O or 1 and I
+const readableStringSource = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// defaultPerPage is the page size used by Paginate when perPage is not positive
+const defaultPerPage = 20
+
 type ErrorTemplate interface {
 	Prepare(err error, status int) any
 }
 
+// ConflictPolicy tells UploadFiles what to do when a file with the same name already exists in the upload
+// directory
+type ConflictPolicy int
+
+const (
+	// ConflictOverwrite replaces the existing file, and is the default
+	ConflictOverwrite ConflictPolicy = iota
+	// ConflictSkip keeps the existing file, leaving the upload out of the returned files
+	ConflictSkip
+	// ConflictError fails the upload with an error wrapping ErrFileExists
+	ConflictError
+	// ConflictRename saves the upload with "-2", "-3" and so on appended to its name, before the extension
+	ConflictRename
+)
+
+// ErrFileExists is returned by UploadFiles when OnConflict is ConflictError and an uploaded file already exists.
+var ErrFileExists = errors.New("file already exists")
+
+// ServerDefaults holds the timeouts RunServer applies to an http.Server whose own timeouts are unset.
+// Zero fields fall back to the values in defaultServerTimeouts.
+type ServerDefaults struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+}
+
+// defaultServerTimeouts protects servers against slow clients (e.g. slowloris) when neither the server
+// nor Tools.ServerDefaults configure a timeout
+var defaultServerTimeouts = ServerDefaults{
+	ReadHeaderTimeout: 5 * time.Second,
+	ReadTimeout:       15 * time.Second,
+	WriteTimeout:      15 * time.Second,
+	IdleTimeout:       60 * time.Second,
+}
+
 // Tools is the type used to instantiate this module. Any variable of this type will
 // have access to all the methods with the receiver *Tools
 type Tools struct {
-	MaxFileSize           int
-	AllowedFileTypes      []string
-	MaxJSONSize           int
-	AllowUnknownFields    bool
-	ErrorResponseTemplate ErrorTemplate
-	signalChan            chan os.Signal
+	MaxFileSize            int
+	MaxIndividualFileSize  int
+	MaxFileCount           int
+	MinFileSize            int
+	AllowedFileTypes       []string
+	VerifyExtension        bool
+	AllowedExtensions      []string
+	BlockedExtensions      []string
+	AtomicUpload           bool
+	ComputeChecksum        bool
+	RenameFunc             func(original string) string
+	PostUploadFunc         func(f *UploadedFile, path string) error
+	MultipartMemory        int64
+	DecompressGzipUploads  bool
+	MaxDecompressedSize    int64
+	BackupWriter           func(filename string) (io.WriteCloser, error)
+	OnConflict             ConflictPolicy
+	UploadConcurrency      int
+	ProgressFunc           func(filename string, bytesWritten, totalBytes int64)
+	MaxFilenameLength      int
+	MaxJSONSize            int
+	MaxXMLSize             int
+	MaxJSONDepth           int
+	AllowUnknownFields     bool
+	RequireJSONContentType bool
+	ErrorResponseTemplate  ErrorTemplate
+	DownloadSecret         string
+	ContentTypeOverrides   map[string]string
+	HTTPClient             *http.Client
+	ServerDefaults         ServerDefaults
+	ShutdownSignals        []os.Signal
+	OnReady                func()
+	OnShutdown             func(ctx context.Context) error
+	Logger                 *slog.Logger
+	RandomStringSource     string
+	MaxSlugLength          int
+	SlugSeparator          string
+	signalChan             chan os.Signal
 }
 
 // New returns an instance of Tools
@@ -52,11 +150,57 @@ func New() *Tools {
 //   - shutdownTimeout: The maximum time to wait for active requests to finish before forcing closure.
 //   - certKeyFiles: An optional variadic slice of strings.
 //     If exactly two strings are provided, they are treated as [certFile, keyFile] for TLS.
+//     The keypair is reloaded whenever either file changes on disk, so renewed certificates
+//     are served on new connections without a restart.
 //     If omitted, the function checks srv.TLSConfig or defaults to standard HTTP.
 //
-// The method blocks until a termination signal (SIGINT, SIGTERM) is received,
+// Timeouts left unset on srv are filled in from t.ServerDefaults (see applyServerDefaults).
+// If t.OnReady is set, it is called as soon as the server is listening for connections.
+// If t.OnShutdown is set, it is called once the server has stopped, whether through srv.Shutdown or because
+// serving failed, with a context bound by shutdownTimeout, to flush logs or close connection pools. Its error
+// is returned by RunServer.
+//
+// The method blocks until a termination signal (t.ShutdownSignals, or SIGINT and SIGTERM by default) is received,
 // the context is canceled, or the server encounters a fatal error.
 func (t *Tools) RunServer(ctx context.Context, srv *http.Server, shutdownTimeout time.Duration, certKeyFiles ...string) error {
+	t.applyServerDefaults(srv)
+
+	useTLS := len(certKeyFiles) == 2 ||
+		(srv.TLSConfig != nil && (len(srv.TLSConfig.Certificates) > 0 || srv.TLSConfig.GetCertificate != nil))
+
+	if len(certKeyFiles) == 2 {
+		reloader, err := newCertReloader(certKeyFiles[0], certKeyFiles[1])
+		if err != nil {
+			return err
+		}
+
+		tlsConfig := srv.TLSConfig.Clone()
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.Certificates = nil
+		tlsConfig.GetCertificate = reloader.getCertificate
+		srv.TLSConfig = tlsConfig
+	}
+
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":http"
+		if useTLS {
+			addr = ":https"
+		}
+	}
+
+	// Bind before serving, so that startup errors are always reported instead of racing with shutdown
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	if t.OnReady != nil {
+		t.OnReady()
+	}
+
 	serverErrChan := make(chan error, 1)
 
 	go func() {
@@ -64,17 +208,18 @@ func (t *Tools) RunServer(ctx context.Context, srv *http.Server, shutdownTimeout
 
 		// Determine if we should use TLS
 		if len(certKeyFiles) == 2 {
-			log.Printf("starting HTTPS server on %s", srv.Addr)
-			err = srv.ListenAndServeTLS(certKeyFiles[0], certKeyFiles[1])
-		} else if srv.TLSConfig != nil && (len(srv.TLSConfig.Certificates) > 0 || srv.TLSConfig.GetCertificate != nil) {
-			log.Printf("starting HTTPS server on %s (using TLSConfig)", srv.Addr)
-			err = srv.ListenAndServeTLS("", "") // Use certs from TLSConfig
+			t.logger().Info("starting HTTPS server", "addr", ln.Addr().String())
+			err = srv.ServeTLS(ln, "", "") // Use the reloading certificate installed in TLSConfig
+		} else if useTLS {
+			t.logger().Info("starting HTTPS server (using TLSConfig)", "addr", ln.Addr().String())
+			err = srv.ServeTLS(ln, "", "") // Use certs from TLSConfig
 		} else {
-			log.Printf("starting HTTP server on %s", srv.Addr)
-			err = srv.ListenAndServe()
+			t.logger().Info("starting HTTP server", "addr", ln.Addr().String())
+			err = srv.Serve(ln)
 		}
 
 		if !errors.Is(err, http.ErrServerClosed) {
+			_ = ln.Close()
 			serverErrChan <- err
 		}
 		close(serverErrChan)
@@ -82,17 +227,26 @@ func (t *Tools) RunServer(ctx context.Context, srv *http.Server, shutdownTimeout
 
 	stop := t.signalChan
 	if stop == nil {
+		signals := t.ShutdownSignals
+		if len(signals) == 0 {
+			signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+		}
+
 		stop = make(chan os.Signal, 1)
-		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		signal.Notify(stop, signals...)
+		defer signal.Stop(stop)
 	}
 
 	select {
 	case err := <-serverErrChan:
-		return err
+		hookCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		return errors.Join(err, t.runOnShutdown(hookCtx))
 	case <-stop:
-		log.Println("shutdown signal received")
+		t.logger().Info("shutdown signal received")
 	case <-ctx.Done():
-		log.Println("context canceled")
+		t.logger().Info("context canceled")
 	}
 
 	shutdownCtx, cancel := context.WithTimeout(
@@ -101,329 +255,3040 @@ func (t *Tools) RunServer(ctx context.Context, srv *http.Server, shutdownTimeout
 	)
 	defer cancel()
 
-	if err := srv.Shutdown(shutdownCtx); err != nil {
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
 		if closeErr := srv.Close(); closeErr != nil {
-			return fmt.Errorf("server forced to close: %w", errors.Join(err, closeErr))
+			err = fmt.Errorf("server forced to close: %w", errors.Join(err, closeErr))
 		}
-		return err
-	}
-
-	log.Println("server exited gracefully")
-	return nil
-}
-
-// RandomString generates a safe random string of length l, using randStringSource as source
-// for the string.
-func (t *Tools) RandomString(l int) string {
-	res := make([]byte, l)
-	for i := range res {
-		n := rand.IntN(len(randStringSource))
-		res[i] = randStringSource[n]
 	}
-	return string(res)
-}
-
-// UploadedFile saves information about an uploaded file
-type UploadedFile struct {
-	OriginalFileName string
-	NewFileName      string
-	FileSize         int64
-}
 
-// UploadFiles uploads an slice of files to a server
-func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, error) {
-	renameFile := true
-	if len(rename) > 0 {
-		renameFile = rename[0]
+	err = errors.Join(err, t.runOnShutdown(shutdownCtx))
+	if err != nil {
+		return err
 	}
 
-	if err := t.CreateDirIfNotExists(uploadDir, 0755); err != nil {
-		return nil, err
+	// Surface any serving error that happened at the same time the shutdown was requested
+	if err := <-serverErrChan; err != nil {
+		return err
 	}
 
-	var uploadedFiles []*UploadedFile
+	t.logger().Info("server exited gracefully")
+	return nil
+}
 
-	if t.MaxFileSize == 0 {
-		t.MaxFileSize = 1024 * 1024 * 1024
+// runOnShutdown calls t.OnShutdown, if set, and wraps the error it returns
+func (t *Tools) runOnShutdown(ctx context.Context) error {
+	if t.OnShutdown == nil {
+		return nil
 	}
 
-	r.Body = http.MaxBytesReader(nil, r.Body, int64(t.MaxFileSize))
-
-	if err := r.ParseMultipartForm(int64(t.MaxFileSize)); err != nil {
-		return nil, errors.New("the uploaded file is too big.")
+	if err := t.OnShutdown(ctx); err != nil {
+		return fmt.Errorf("shutdown hook: %w", err)
 	}
+	return nil
+}
 
-	for _, fHeaders := range r.MultipartForm.File {
-		for _, hdr := range fHeaders {
+// RunServers runs each of servers with RunServer, which is useful to serve an application and its metrics
+// endpoint on separate ports. All of them are shut down gracefully when a termination signal is received,
+// ctx is canceled or any of them fails. It blocks until every server has stopped and returns their errors
+// joined together. If t.OnReady is set, it is called once for each server, while t.OnShutdown is called only
+// once, after every server has stopped.
+func (t *Tools) RunServers(ctx context.Context, shutdownTimeout time.Duration, servers ...*http.Server) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-			uploadedFile, err := func() (*UploadedFile, error) {
-				var uploadedFile UploadedFile
-				infile, err := hdr.Open()
-				if err != nil {
-					return nil, err
-				}
-				defer infile.Close()
+	// the servers run without the hook, so that it can be called once for all of them
+	run := *t
+	run.OnShutdown = nil
 
-				buffer := make([]byte, 512)
-				if _, err = infile.Read(buffer); err != nil {
-					return nil, err
-				}
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
 
-				allowed := false
-				contenType := http.DetectContentType(buffer)
-				if len(t.AllowedFileTypes) > 0 {
-					for _, ft := range t.AllowedFileTypes {
-						if strings.EqualFold(contenType, ft) {
-							allowed = true
-						}
-					}
-				} else {
-					allowed = true
-				}
+	for i, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 
-				if !allowed {
-					return nil, errors.New("invalid file type")
-				}
+			errs[i] = run.RunServer(ctx, srv, shutdownTimeout)
 
-				if _, err := infile.Seek(0, 0); err != nil {
-					return nil, err
-				}
+			// whatever stopped this server, the others must follow
+			cancel()
+		}()
+	}
 
-				uploadedFile.OriginalFileName = hdr.Filename
+	wg.Wait()
 
-				if renameFile {
-					uploadedFile.NewFileName = fmt.Sprintf("%s%s", t.RandomString(25), filepath.Ext(hdr.Filename))
-				} else {
-					uploadedFile.NewFileName = hdr.Filename
-				}
+	hookCtx, cancelHook := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelHook()
 
-				outfile, err := os.Create(filepath.Join(uploadDir, uploadedFile.NewFileName))
-				if err != nil {
-					return nil, err
-				}
+	return errors.Join(append(errs, t.runOnShutdown(hookCtx))...)
+}
 
-				defer outfile.Close()
-				fileSize, err := io.Copy(outfile, infile)
-				if err != nil {
-					return nil, err
-				}
-				uploadedFile.FileSize = fileSize
+// certReloader serves a TLS keypair loaded from disk, reloading it when the files are modified
+type certReloader struct {
+	certFile, keyFile string
 
-				return &uploadedFile, nil
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
 
-			}()
+// newCertReloader returns a certReloader for certFile and keyFile, failing if they can't be loaded
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.getCertificate(nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
 
-			if err != nil {
-				return uploadedFiles, err
+// getCertificate implements tls.Config.GetCertificate. The files are checked on every handshake, and if
+// reloading a changed keypair fails, the previous one keeps being served.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var modTime time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			if c.cert != nil {
+				return c.cert, nil
 			}
-			uploadedFiles = append(uploadedFiles, uploadedFile)
+			return nil, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
 		}
 	}
-	return uploadedFiles, nil
-}
 
-func (t *Tools) UploadOneFile(r *http.Request, uploadDir string, rename ...bool) (*UploadedFile, error) {
-	renameFile := true
-	if len(rename) > 0 {
-		renameFile = rename[0]
+	if c.cert != nil && modTime.Equal(c.modTime) {
+		return c.cert, nil
 	}
 
-	files, err := t.UploadFiles(r, uploadDir, renameFile)
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
 	if err != nil {
+		if c.cert != nil {
+			return c.cert, nil
+		}
 		return nil, err
 	}
-	return files[0], nil
+
+	c.cert = &cert
+	c.modTime = modTime
+	return c.cert, nil
 }
 
-// CreateDirIfNotExists creates a dir if it does not exist
-func (t *Tools) CreateDirIfNotExists(path string, mode os.FileMode) error {
-	if err := os.MkdirAll(path, mode); err != nil {
-		return err
+// logger returns t.Logger, or the default slog logger, which writes through the standard log package,
+// when none is set
+func (t *Tools) logger() *slog.Logger {
+	if t.Logger != nil {
+		return t.Logger
 	}
-	return nil
+	return slog.Default()
 }
 
-// Slugfy creates a simple slug from a string
-func (t *Tools) Slugfy(s string) (string, error) {
-	if s == "" {
-		return "", errors.New("empty string not allowed")
+// applyServerDefaults sets the timeouts of srv that are zero to the ones in t.ServerDefaults,
+// or to defaultServerTimeouts when those are not set either
+func (t *Tools) applyServerDefaults(srv *http.Server) {
+	pick := func(configured, fallback time.Duration) time.Duration {
+		if configured > 0 {
+			return configured
+		}
+		return fallback
 	}
 
-	re := regexp.MustCompile(`[^a-z\d]+`)
-	slug := strings.Trim(re.ReplaceAllString(strings.ToLower(s), "-"), "-")
-	if len(slug) == 0 {
-		return "", errors.New("empty string, after slug process")
+	if srv.ReadHeaderTimeout == 0 {
+		srv.ReadHeaderTimeout = pick(t.ServerDefaults.ReadHeaderTimeout, defaultServerTimeouts.ReadHeaderTimeout)
 	}
 
-	return slug, nil
+	if srv.ReadTimeout == 0 {
+		srv.ReadTimeout = pick(t.ServerDefaults.ReadTimeout, defaultServerTimeouts.ReadTimeout)
+	}
+
+	if srv.WriteTimeout == 0 {
+		srv.WriteTimeout = pick(t.ServerDefaults.WriteTimeout, defaultServerTimeouts.WriteTimeout)
+	}
+
+	if srv.IdleTimeout == 0 {
+		srv.IdleTimeout = pick(t.ServerDefaults.IdleTimeout, defaultServerTimeouts.IdleTimeout)
+	}
 }
 
-// DownloadStaticFile downloads a file, and tries to force the browser to avoid displaying it
-// in the browser window by setting content disposition. It also allows specification of
-// the display name
-func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, p, file, displayName string) {
-	filePath := filepath.Join(p, file)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", displayName))
+// RandomString generates a safe random string of length l, using t.RandomStringSource as source
+// for the string, or randStringSource when none is set.
+func (t *Tools) RandomString(l int) string {
+	return t.RandomStringFromSource(l, t.RandomStringSource)
+}
 
-	http.ServeFile(w, r, filePath)
+// RandomStringFromSource generates a random string of length l, picking its characters from source.
+// If source is empty, randStringSource is used instead.
+func (t *Tools) RandomStringFromSource(l int, source string) string {
+	if source == "" {
+		source = randStringSource
+	}
+
+	s := []rune(source)
+	res := make([]rune, l)
+	for i := range res {
+		n := rand.IntN(len(s))
+		res[i] = s[n]
+	}
+	return string(res)
 }
 
-// JSONResponse is the type fo sending json around
-type JSONResponse struct {
-	Error   bool        `json:"error"`
-	Message string      `json:"message"`
-	Data    interface{} `json:"data,omitempty"`
+// RandomReadableString generates a random string of length l made of upper case letters and digits that
+// can't be mistaken for one another, leaving out 0, O, 1, I and L. It suits codes people read and type,
+// such as vouchers and one-time PINs.
+func (t *Tools) RandomReadableString(l int) string {
+	return t.RandomStringFromSource(l, readableStringSource)
 }
 
-func (j JSONResponse) Prepare(err error, status int) interface{} {
-	return JSONResponse{
-		Error:   true,
-		Message: err.Error(),
-		Data:    status,
+// RandomSecureString generates a random string of length l using crypto/rand, which makes it suitable
+// for session tokens, password reset codes and API keys. It panics if the system's secure random
+// number generator fails; use RandomSecureStringE to handle that error instead.
+func (t *Tools) RandomSecureString(l int) string {
+	s, err := t.RandomSecureStringE(l)
+	if err != nil {
+		panic(err)
 	}
+	return s
 }
 
-// ReadJSON tries to read the body os a request and converts from json to a go data variable.
-// The data parameter takes a pointer of any kind as argument
-func (t *Tools) ReadJSON(w http.ResponseWriter, r *http.Request, data interface{}) error {
-	// 1. Set file limit
-	maxBytes := 1024 * 1024
-	if t.MaxJSONSize > 0 {
-		maxBytes = t.MaxJSONSize
+// RandomSecureStringE generates a random string of length l using crypto/rand, picking its characters
+// from t.RandomStringSource, or randStringSource when none is set.
+func (t *Tools) RandomSecureStringE(l int) (string, error) {
+	source := t.RandomStringSource
+	if source == "" {
+		source = randStringSource
 	}
 
-	// 2. Read body with the limit set
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
-	defer r.Body.Close()
+	s := []rune(source)
+	limit := big.NewInt(int64(len(s)))
+	res := make([]rune, l)
+	for i := range res {
+		n, err := crand.Int(crand.Reader, limit)
+		if err != nil {
+			return "", err
+		}
+		res[i] = s[n.Int64()]
+	}
+	return string(res), nil
+}
 
-	// 3. Create new JSON decoder
-	dec := json.NewDecoder(r.Body)
+// RandomInt returns a random integer in the half-open range [low, high), using the same random source
+// as RandomString. It panics if low is not less than high.
+func (t *Tools) RandomInt(low, high int) int {
+	if low >= high {
+		panic(fmt.Sprintf("invalid range: %d must be less than %d", low, high))
+	}
+	// the width is computed as uint64, since high-low overflows int on ranges wider than math.MaxInt
+	return low + int(rand.Uint64N(uint64(high)-uint64(low)))
+}
 
-	if !t.AllowUnknownFields {
-		dec.DisallowUnknownFields()
+// RandomSecureInt returns a random integer in the half-open range [low, high) using crypto/rand, which
+// makes it suitable for numeric verification codes. It panics if low is not less than high or if the
+// system's secure random number generator fails.
+func (t *Tools) RandomSecureInt(low, high int) int {
+	if low >= high {
+		panic(fmt.Sprintf("invalid range: %d must be less than %d", low, high))
 	}
 
-	// 4. Decode data
-	err := dec.Decode(data)
+	n, err := crand.Int(crand.Reader, new(big.Int).SetUint64(uint64(high)-uint64(low)))
 	if err != nil {
-		var (
-			syntaxError           *json.SyntaxError
-			unmarshalTypeError    *json.UnmarshalTypeError
-			invalidUnmarshalError *json.InvalidUnmarshalError
-		)
-
-		switch {
-		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+		panic(err)
+	}
+	return low + int(n.Uint64())
+}
 
-		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly-formed JSON")
+// RandomPick returns a random element of items, or an error if items is empty. Go doesn't allow type
+// parameters on methods, so unlike the other helpers it is a package level function.
+func RandomPick[T any](items []T) (T, error) {
+	var zero T
+	if len(items) == 0 {
+		return zero, errors.New("cannot pick from an empty slice")
+	}
 
-		case errors.As(err, &unmarshalTypeError):
-			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
-			}
+	var t Tools
+	return items[t.RandomInt(0, len(items))], nil
+}
 
-			return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+// UploadedFile saves information about an uploaded file
+type UploadedFile struct {
+	OriginalFileName string
+	NewFileName      string
+	FilePath         string
+	FileSize         int64
+	Checksum         string
+	ContentType      string
+}
 
-		case errors.Is(err, io.EOF):
-			return errors.New("body must not be empty")
+// UploadFiles uploads an slice of files to a server. If PostUploadFunc is set, it is called after each file
+// is written with the path it was saved to, and any error it returns aborts the upload and removes that file.
+// Files saved before it are kept and returned, unless AtomicUpload is set. If BackupWriter is set, each file
+// is also copied to the writer it returns, in the same pass. If UploadConcurrency is greater than 1,
+// PostUploadFunc and ProgressFunc are called from several goroutines at once.
+func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, error) {
+	return t.UploadFilesContext(r.Context(), r, uploadDir, rename...)
+}
 
-		case strings.HasPrefix(err.Error(), "json: unknown field"):
-			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field")
-			return fmt.Errorf("body contains unknown key %s", fieldName)
+// UploadFilesContext uploads an slice of files to a server, aborting as soon as ctx is done.
+// A file that was being written when ctx got canceled is removed from uploadDir.
+func (t *Tools) UploadFilesContext(ctx context.Context, r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, error) {
+	renameFile := true
+	if len(rename) > 0 {
+		renameFile = rename[0]
+	}
 
-		case err.Error() == "http: request body too large":
-			return fmt.Errorf("body must no be larger than %d bytes", maxBytes)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-		case errors.As(err, &invalidUnmarshalError):
-			return fmt.Errorf("error unmarshaling JSON: %s", err.Error())
+	if err := t.CreateDirIfNotExists(uploadDir, 0755); err != nil {
+		return nil, err
+	}
 
-		default:
-			return err
-		}
+	create := t.createInDir(uploadDir)
+	remove := func(name string) {
+		_ = os.Remove(filepath.Join(uploadDir, name))
 	}
 
-	// 5. Set safety condition
-	err = dec.Decode(&struct{}{})
-	if err != io.EOF {
-		return errors.New("body must contain only one JSON value")
+	filePath := func(name string) string {
+		return filepath.Join(uploadDir, name)
 	}
 
-	return nil
+	return t.uploadFiles(ctx, r, renameFile, create, remove, filePath)
 }
 
-// WriteJSON takes a response status code and arbitrary data and writes json to the client.
-// The data parameter takes a pointer of any kind as argument.
-func (t *Tools) WriteJSON(w http.ResponseWriter, status int, data interface{}, headers ...http.Header) error {
-	out, err := json.Marshal(data)
-	if err != nil {
-		return err
+// createInDir returns a function creating files in dir. Unless t.OnConflict allows overwriting files, they
+// are created exclusively, so that a file created by another request since the conflict check is never
+// truncated. os.ErrExist is returned instead.
+func (t *Tools) createInDir(dir string) func(name string) (io.WriteCloser, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if t.OnConflict != ConflictOverwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
 	}
 
-	if len(headers) > 0 {
-		maps.Copy(w.Header(), headers[0])
+	return func(name string) (io.WriteCloser, error) {
+		return os.OpenFile(filepath.Join(dir, name), flags, 0666)
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	_, err = w.Write(out)
-	if err != nil {
-		return err
+// UploadSummary holds aggregate information about a batch of uploaded files
+type UploadSummary struct {
+	TotalFiles int
+	TotalBytes int64
+	Files      []*UploadedFile
+}
+
+// UploadFilesWithSummary uploads an slice of files to a server just like UploadFiles, and returns
+// the uploaded files along with the total number of files and bytes saved.
+func (t *Tools) UploadFilesWithSummary(r *http.Request, uploadDir string, rename ...bool) (*UploadSummary, error) {
+	files, err := t.UploadFiles(r, uploadDir, rename...)
+
+	summary := &UploadSummary{
+		TotalFiles: len(files),
+		Files:      files,
+	}
+	for _, f := range files {
+		summary.TotalBytes += f.FileSize
 	}
 
-	return nil
+	return summary, err
 }
 
-// ErrorJSON is a convenience method for error handling and writing to JSON.
-// It receives a variadic status code, if none is passed Bad Request will be set as default.
-func (t *Tools) ErrorJSON(w http.ResponseWriter, err error, status ...int) error {
-	statusCode := http.StatusBadRequest
+// UploadFilesWithFields uploads an slice of files to a server just like UploadFiles, and also returns the
+// regular text fields sent in the same multipart form. After UploadFiles, those fields are also available
+// through r.FormValue and r.MultipartForm.Value.
+func (t *Tools) UploadFilesWithFields(r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, map[string][]string, error) {
+	files, err := t.UploadFiles(r, uploadDir, rename...)
 
-	if len(status) > 0 {
-		statusCode = status[0]
+	var fields map[string][]string
+	if r.MultipartForm != nil {
+		fields = r.MultipartForm.Value
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
+	return files, fields, err
+}
 
-	var payload interface{}
-	if t.ErrorResponseTemplate != nil {
-		payload = t.ErrorResponseTemplate.Prepare(err, statusCode)
-	} else {
-		payload = JSONResponse{}.Prepare(err, 0)
+// UploadFilesToWriter performs the same validation as UploadFiles, but instead of saving the files to
+// a local directory it streams each of them to the writer returned by newWriter, which receives the
+// name the file would be saved with. This allows storing uploads in backends such as S3 or GCS.
+func (t *Tools) UploadFilesToWriter(r *http.Request, newWriter func(filename string) (io.WriteCloser, error), rename ...bool) ([]*UploadedFile, error) {
+	renameFile := true
+	if len(rename) > 0 {
+		renameFile = rename[0]
 	}
 
-	return t.WriteJSON(w, statusCode, payload)
+	return t.uploadFiles(r.Context(), r, renameFile, newWriter, nil, nil)
 }
 
-// PushJSONToRemote posts arbitrary data to some URL as JSON, and returns the response, status code and error, if any.
-// The final parameter, client, is optional. If none is specified, standard http.Client is set as default.
-func (t *Tools) PushJSONToRemote(uri string, data interface{}, client ...*http.Client) (*http.Response, int, error) {
-	// create json
-	out, err := json.Marshal(data)
-	if err != nil {
-		return nil, 0, err
-	}
+// InMemoryFile is a file uploaded with UploadFilesToMemory
+type InMemoryFile struct {
+	Filename    string
+	ContentType string
+	Content     []byte
+}
 
-	// check for the custom http client
-	httpClient := &http.Client{}
-	if len(client) > 0 {
-		httpClient = client[0]
+// UploadFilesToMemory performs the same validation as UploadFiles, such as MaxFileSize and AllowedFileTypes,
+// but returns the content of the files instead of saving them, which suits small uploads like config files.
+// Filename is the name the file was sent with. RenameFunc, BackupWriter and PostUploadFunc are not used.
+// Since the whole content is held in memory, MaxFileSize should be kept low.
+func (t *Tools) UploadFilesToMemory(r *http.Request) ([]*InMemoryFile, error) {
+	var (
+		mu       sync.Mutex
+		contents = make(map[string]*bytes.Buffer)
+		seq      atomic.Int64
+	)
+
+	// each part is named after a sequence number, which keys its buffer
+	mem := *t
+	mem.RenameFunc = func(string) string {
+		return strconv.FormatInt(seq.Add(1), 10)
+	}
+	mem.BackupWriter = nil
+	mem.PostUploadFunc = nil
+	mem.MaxFilenameLength = 0
+
+	create := func(name string) (io.WriteCloser, error) {
+		buf := new(bytes.Buffer)
+		mu.Lock()
+		contents[name] = buf
+		mu.Unlock()
+		return nopWriteCloser{buf}, nil
+	}
+	remove := func(name string) {
+		mu.Lock()
+		delete(contents, name)
+		mu.Unlock()
 	}
 
-	// build the request and set the header
-	request, err := http.NewRequest("POST", uri, bytes.NewBuffer(out))
+	uploaded, err := mem.uploadFiles(r.Context(), r, true, create, remove, nil)
 	if err != nil {
-		return nil, http.StatusBadRequest, err
+		return nil, err
 	}
-	request.Header.Set("Content-Type", "application/json")
 
-	// call the remote uri
-	response, err := httpClient.Do(request)
-	if err != nil {
-		return nil, 0, err
+	files := make([]*InMemoryFile, 0, len(uploaded))
+	for _, f := range uploaded {
+		files = append(files, &InMemoryFile{
+			Filename:    f.OriginalFileName,
+			ContentType: f.ContentType,
+			Content:     contents[f.NewFileName].Bytes(),
+		})
 	}
-	// send response back
-	return response, response.StatusCode, nil
+
+	return files, nil
+}
+
+// BuildMultipartRequest returns a POST request with a multipart/form-data body holding files, keyed by
+// file name, under the form field fieldName, and the text fields. It is meant for testing upload handlers
+// built on this package. Files and fields are written in the sorted order of their names.
+func (t *Tools) BuildMultipartRequest(fieldName string, files map[string][]byte, fields map[string]string) (*http.Request, error) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		if err := writer.WriteField(name, fields[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		part, err := writer.CreateFormFile(fieldName, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := part.Write(files[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, "/", body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return request, nil
+}
+
+// ValidateUpload runs the same checks as UploadFiles on the files sent in r, such as size, extension and
+// type, without storing them. It returns the metadata the files would be uploaded with, which allows
+// rejecting a request early. FilePath is left empty, since nothing is written.
+func (t *Tools) ValidateUpload(r *http.Request, rename ...bool) ([]*UploadedFile, error) {
+	renameFile := true
+	if len(rename) > 0 {
+		renameFile = rename[0]
+	}
+
+	return t.uploadFiles(r.Context(), r, renameFile, nil, nil, nil)
+}
+
+// errTooManyFileParts stops reading a multipart body that has more file parts than allowed
+var errTooManyFileParts = errors.New("too many file parts")
+
+// limitFileParts makes reading the multipart body of r fail as soon as more than limit file parts have
+// been streamed, so that ParseMultipartForm doesn't spool the extra files to memory or disk first. The body
+// is teed to a multipart.Reader that counts the parts as they arrive. The returned function must be called
+// once the body has been read, and reports whether the limit was exceeded.
+func limitFileParts(r *http.Request, limit int) func() bool {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		// ParseMultipartForm rejects the request anyway
+		return func() bool { return false }
+	}
+
+	pr, pw := io.Pipe()
+	var exceeded atomic.Bool
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		mr := multipart.NewReader(pr, params["boundary"])
+		count := 0
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+
+			if part.FileName() != "" {
+				count++
+				if count > limit {
+					exceeded.Store(true)
+					pr.CloseWithError(errTooManyFileParts)
+					return
+				}
+			}
+		}
+
+		// keep consuming, so that the body can still be read past a malformed part
+		_, _ = io.Copy(io.Discard, pr)
+	}()
+
+	r.Body = teeBody{Reader: io.TeeReader(r.Body, pw), body: r.Body}
+
+	return func() bool {
+		pw.Close()
+		<-done
+		return exceeded.Load()
+	}
+}
+
+// teeBody reads from a TeeReader and closes the underlying request body on Close
+type teeBody struct {
+	io.Reader
+	body io.Closer
+}
+
+func (b teeBody) Close() error {
+	return b.body.Close()
+}
+
+// uploadFiles validates every file sent in the multipart request r and copies it to the writer returned
+// by create. If remove is not nil, it is used to discard partially written files and, when AtomicUpload
+// is set, every file already saved from the batch. If create is nil, files are only validated and read,
+// without being stored anywhere, and PostUploadFunc is not called.
+func (t *Tools) uploadFiles(ctx context.Context, r *http.Request, renameFile bool, create func(name string) (io.WriteCloser, error), remove func(name string), filePath func(name string) string) ([]*UploadedFile, error) {
+	var uploadedFiles []*UploadedFile
+
+	if t.MaxFileSize == 0 {
+		t.MaxFileSize = 1024 * 1024 * 1024
+	}
+
+	r.Body = http.MaxBytesReader(nil, r.Body, int64(t.MaxFileSize))
+
+	multipartMemory := t.MultipartMemory
+	if multipartMemory <= 0 {
+		multipartMemory = int64(t.MaxFileSize)
+	}
+
+	tooManyFiles := func() bool { return false }
+	if t.MaxFileCount > 0 {
+		tooManyFiles = limitFileParts(r, t.MaxFileCount)
+	}
+
+	err := r.ParseMultipartForm(multipartMemory)
+	if tooManyFiles() {
+		if r.MultipartForm != nil {
+			r.MultipartForm.RemoveAll()
+		}
+		return nil, fmt.Errorf("too many files: more than %d files were sent", t.MaxFileCount)
+	}
+	if err != nil {
+		return nil, errors.New("the uploaded file is too big.")
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	// createFile applies t.OnConflict to name and creates the file. Both steps happen under createMu, so that
+	// concurrent workers can't claim the same free name. If another request creates the file in between, which
+	// the exclusive creation reports as os.ErrExist, the conflict is resolved again. It reports whether the
+	// file must be skipped.
+	var createMu sync.Mutex
+	createFile := func(name string) (string, io.WriteCloser, bool, error) {
+		createMu.Lock()
+		defer createMu.Unlock()
+
+		checkConflicts := filePath != nil && t.OnConflict != ConflictOverwrite
+		for {
+			candidate := name
+			if checkConflicts {
+				newName, skip, err := t.resolveConflict(name, filePath)
+				if err != nil || skip {
+					return "", nil, skip, err
+				}
+				candidate = newName
+			}
+
+			outfile, err := create(candidate)
+			if checkConflicts && errors.Is(err, os.ErrExist) {
+				continue
+			}
+			return candidate, outfile, false, err
+		}
+	}
+
+	uploadFile := func(hdr *multipart.FileHeader) (*UploadedFile, error) {
+		var uploadedFile UploadedFile
+		if t.MaxIndividualFileSize > 0 && hdr.Size > int64(t.MaxIndividualFileSize) {
+			return nil, fmt.Errorf("file %s is too big: %d bytes exceeds the limit of %d bytes", hdr.Filename, hdr.Size, t.MaxIndividualFileSize)
+		}
+
+		if !t.extensionAllowed(hdr.Filename) {
+			return nil, fmt.Errorf("file extension of %s is not allowed", hdr.Filename)
+		}
+
+		if hdr.Size < int64(t.MinFileSize) {
+			return nil, fmt.Errorf("file %s is too small: %d bytes is below the minimum of %d bytes", hdr.Filename, hdr.Size, t.MinFileSize)
+		}
+
+		infile, err := hdr.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer infile.Close()
+
+		buffer := make([]byte, 512)
+		n, err := io.ReadFull(infile, buffer)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		// src is what gets stored, either the upload itself or its decompressed content, in which case
+		// the type checks apply to the decompressed data and the .gz extension is dropped
+		var src io.Reader = infile
+		name := hdr.Filename
+		decompressed := false
+		if t.DecompressGzipUploads && (strings.EqualFold(filepath.Ext(name), ".gz") || bytes.HasPrefix(buffer[:n], []byte{0x1f, 0x8b})) {
+			if _, err := infile.Seek(0, 0); err != nil {
+				return nil, err
+			}
+
+			gz, err := gzip.NewReader(infile)
+			if err != nil {
+				return nil, fmt.Errorf("file %s is not valid gzip data: %w", hdr.Filename, err)
+			}
+			defer gz.Close()
+
+			n, err = io.ReadFull(gz, buffer)
+			if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("file %s is not valid gzip data: %w", hdr.Filename, err)
+			}
+
+			// the decompressed data is capped, so that a small gzip bomb can't fill the disk
+			src = http.MaxBytesReader(nil, io.NopCloser(io.MultiReader(bytes.NewReader(buffer[:n]), gz)), t.maxDecompressedBytes())
+			decompressed = true
+			if strings.EqualFold(filepath.Ext(name), ".gz") {
+				name = strings.TrimSuffix(name, filepath.Ext(name))
+			}
+		} else if _, err := infile.Seek(0, 0); err != nil {
+			return nil, err
+		}
+
+		contenType := http.DetectContentType(buffer[:n])
+		if contenType == "application/zip" && !decompressed {
+			if t.MaxDecompressedSize > 0 {
+				if err := checkZipSize(infile, hdr.Size, t.MaxDecompressedSize); err != nil {
+					return nil, fmt.Errorf("file %s %w", hdr.Filename, err)
+				}
+			}
+
+			if t.allowsOfficeFileTypes() {
+				contenType = zipContentType(infile, hdr.Size)
+			}
+		}
+
+		if !t.IsAllowedFileType(contenType) {
+			return nil, fmt.Errorf("invalid file type %s for file %s", contenType, hdr.Filename)
+		}
+
+		if t.VerifyExtension && !extensionMatchesContentType(name, contenType) {
+			return nil, fmt.Errorf("file extension of %s does not match its detected type %s", hdr.Filename, contenType)
+		}
+
+		uploadedFile.OriginalFileName = hdr.Filename
+		uploadedFile.ContentType = contenType
+
+		if renameFile && t.RenameFunc != nil {
+			uploadedFile.NewFileName = t.RenameFunc(name)
+		} else if renameFile {
+			uploadedFile.NewFileName = fmt.Sprintf("%s%s", t.RandomString(25), filepath.Ext(name))
+		} else {
+			uploadedFile.NewFileName = t.SanitizeFilename(name)
+		}
+
+		if t.MaxFilenameLength > 0 {
+			uploadedFile.NewFileName = truncateFilename(uploadedFile.NewFileName, t.MaxFilenameLength)
+		}
+
+		var outfile io.WriteCloser = nopWriteCloser{io.Discard}
+		if create != nil {
+			newName, f, skip, err := createFile(uploadedFile.NewFileName)
+			if err != nil || skip {
+				return nil, err
+			}
+			uploadedFile.NewFileName, outfile = newName, f
+
+			if t.BackupWriter != nil {
+				backup, err := t.BackupWriter(uploadedFile.NewFileName)
+				if err != nil {
+					outfile.Close()
+					if remove != nil {
+						remove(uploadedFile.NewFileName)
+					}
+					return nil, err
+				}
+				outfile = teeWriteCloser{Writer: io.MultiWriter(outfile, backup), closers: []io.Closer{outfile, backup}}
+			}
+		}
+
+		var dst io.Writer = outfile
+		hash := sha256.New()
+		if t.ComputeChecksum {
+			dst = io.MultiWriter(outfile, hash)
+		}
+		if t.ProgressFunc != nil {
+			// the size of decompressed uploads is only known once they are written
+			total := hdr.Size
+			if decompressed {
+				total = -1
+			}
+			dst = &progressWriter{w: dst, filename: hdr.Filename, total: total, report: t.ProgressFunc}
+		}
+
+		fileSize, err := io.Copy(dst, contextReader{ctx: ctx, r: src})
+		var maxBytesError *http.MaxBytesError
+		if decompressed && errors.As(err, &maxBytesError) {
+			err = fmt.Errorf("file %s is too big when decompressed: it exceeds the limit of %d bytes", hdr.Filename, maxBytesError.Limit)
+		}
+		if closeErr := outfile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			if remove != nil {
+				remove(uploadedFile.NewFileName)
+			}
+			return nil, err
+		}
+		uploadedFile.FileSize = fileSize
+		if t.ComputeChecksum {
+			uploadedFile.Checksum = hex.EncodeToString(hash.Sum(nil))
+		}
+		if filePath != nil {
+			uploadedFile.FilePath = filePath(uploadedFile.NewFileName)
+		}
+
+		if t.PostUploadFunc != nil && create != nil {
+			if err := t.PostUploadFunc(&uploadedFile, uploadedFile.FilePath); err != nil {
+				// the rejected file is not returned, so it's removed whether or not the upload is atomic
+				if remove != nil {
+					remove(uploadedFile.NewFileName)
+				}
+				return nil, err
+			}
+		}
+
+		return &uploadedFile, nil
+	}
+
+	var headers []*multipart.FileHeader
+	for _, fHeaders := range r.MultipartForm.File {
+		headers = append(headers, fHeaders...)
+	}
+
+	if t.UploadConcurrency > 1 {
+		return t.uploadConcurrently(headers, uploadFile, remove)
+	}
+
+	for _, hdr := range headers {
+		uploadedFile, err := uploadFile(hdr)
+		if err != nil {
+			if t.AtomicUpload {
+				if remove != nil {
+					for _, f := range uploadedFiles {
+						remove(f.NewFileName)
+					}
+				}
+				return nil, err
+			}
+			return uploadedFiles, err
+		}
+		if uploadedFile != nil {
+			uploadedFiles = append(uploadedFiles, uploadedFile)
+		}
+	}
+	return uploadedFiles, nil
+}
+
+// uploadConcurrently runs uploadFile for each of headers on t.UploadConcurrency workers, returning the
+// uploaded files in the order of headers. Once a file fails, no new file is started and the error of the
+// first failing file is returned, along with the files uploaded, unless AtomicUpload removes them.
+func (t *Tools) uploadConcurrently(headers []*multipart.FileHeader, uploadFile func(hdr *multipart.FileHeader) (*UploadedFile, error), remove func(name string)) ([]*UploadedFile, error) {
+	results := make([]*UploadedFile, len(headers))
+	errs := make([]error, len(headers))
+
+	var (
+		wg     sync.WaitGroup
+		failed atomic.Bool
+	)
+
+	jobs := make(chan int)
+	for range min(t.UploadConcurrency, len(headers)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i], errs[i] = uploadFile(headers[i])
+				if errs[i] != nil {
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+
+	for i := range headers {
+		if failed.Load() {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var uploadedFiles []*UploadedFile
+	for _, f := range results {
+		if f != nil {
+			uploadedFiles = append(uploadedFiles, f)
+		}
+	}
+
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+
+		if t.AtomicUpload {
+			if remove != nil {
+				for _, f := range uploadedFiles {
+					remove(f.NewFileName)
+				}
+			}
+			return nil, err
+		}
+		return uploadedFiles, err
+	}
+
+	return uploadedFiles, nil
+}
+
+// resolveConflict applies t.OnConflict to an upload named name, whose path is given by filePath. It
+// returns the name to save the upload with, or whether it must be skipped.
+func (t *Tools) resolveConflict(name string, filePath func(name string) string) (string, bool, error) {
+	exists := func(n string) (bool, error) {
+		_, err := os.Stat(filePath(n))
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	found, err := exists(name)
+	if err != nil || !found {
+		return name, false, err
+	}
+
+	switch t.OnConflict {
+	case ConflictSkip:
+		return "", true, nil
+	case ConflictError:
+		return "", false, fmt.Errorf("%s: %w", name, ErrFileExists)
+	case ConflictRename:
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for i := 2; ; i++ {
+			// the base name is shortened if needed, so that the suffix keeps the name within MaxFilenameLength
+			suffix := fmt.Sprintf("-%d%s", i, ext)
+			candidate := base + suffix
+			if t.MaxFilenameLength > 0 && len(candidate) > t.MaxFilenameLength {
+				candidate = cutAtRune(base, max(t.MaxFilenameLength-len(suffix), 0)) + suffix
+			}
+			if found, err := exists(candidate); err != nil || !found {
+				return candidate, false, err
+			}
+		}
+	}
+
+	return name, false, nil
+}
+
+// nopWriteCloser is an io.WriteCloser whose Close does nothing
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// progressWriter passes writes through to w, reporting the number of bytes written so far after each one
+type progressWriter struct {
+	w        io.Writer
+	filename string
+	written  int64
+	total    int64
+	report   func(filename string, bytesWritten, totalBytes int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	p.report(p.filename, p.written, p.total)
+	return n, err
+}
+
+// teeWriteCloser writes to several destinations through Writer and closes all of them on Close
+type teeWriteCloser struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (t teeWriteCloser) Close() error {
+	var errs []error
+	for _, c := range t.closers {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// contextReader is an io.Reader that stops reading from r once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+func (t *Tools) UploadOneFile(r *http.Request, uploadDir string, rename ...bool) (*UploadedFile, error) {
+	renameFile := true
+	if len(rename) > 0 {
+		renameFile = rename[0]
+	}
+
+	files, err := t.UploadFiles(r, uploadDir, renameFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("no file uploaded")
+	}
+	return files[0], nil
+}
+
+// officeContentTypes maps a file found only in Office Open XML documents to the MIME type of the document
+var officeContentTypes = map[string]string{
+	"word/document.xml":    "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"xl/workbook.xml":      "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"ppt/presentation.xml": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+}
+
+// DetectContentType returns the MIME type of the data read from r. Unlike http.DetectContentType, which
+// only sees the first 512 bytes, it inspects the central directory of zip archives to tell Office documents
+// such as .docx, .xlsx and .pptx files apart from plain zip files. r is read to the end.
+func (t *Tools) DetectContentType(r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	contentType := http.DetectContentType(data)
+	if contentType == "application/zip" {
+		contentType = zipContentType(bytes.NewReader(data), int64(len(data)))
+	}
+
+	return contentType, nil
+}
+
+// FileContentType returns the MIME type of the file at path, sniffed from its first 512 bytes. When
+// sniffing only finds it to be application/octet-stream, the type registered for its extension, if any,
+// is returned instead.
+func (t *Tools) FileContentType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buffer := make([]byte, 512)
+	n, err := io.ReadFull(f, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	contentType := http.DetectContentType(buffer[:n])
+	if contentType == "application/octet-stream" {
+		if byExtension := mime.TypeByExtension(filepath.Ext(path)); byExtension != "" {
+			contentType = byExtension
+		}
+	}
+
+	return contentType, nil
+}
+
+// zipContentType returns the MIME type of the Office document stored in the zip archive ra of the given
+// size, or application/zip if it is not one
+func zipContentType(ra io.ReaderAt, size int64) string {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return "application/zip"
+	}
+
+	for _, f := range zr.File {
+		if contentType, ok := officeContentTypes[f.Name]; ok {
+			return contentType
+		}
+	}
+
+	return "application/zip"
+}
+
+// maxDecompressedBytes returns the most bytes a gzip upload may decompress to: MaxDecompressedSize, or else
+// MaxIndividualFileSize, or else MaxFileSize
+func (t *Tools) maxDecompressedBytes() int64 {
+	switch {
+	case t.MaxDecompressedSize > 0:
+		return t.MaxDecompressedSize
+	case t.MaxIndividualFileSize > 0:
+		return int64(t.MaxIndividualFileSize)
+	default:
+		return int64(t.MaxFileSize)
+	}
+}
+
+// maxZipCompressionRatio is the highest ratio between the uncompressed and compressed sizes of an uploaded
+// zip archive accepted when MaxDecompressedSize is set. Regular files rarely go beyond 10 to 1.
+const maxZipCompressionRatio = 100
+
+// checkZipSize returns an error if the zip archive ra of the given size declares more than limit
+// uncompressed bytes, or compresses them suspiciously well, as zip bombs do. Archives that can't be
+// read are left for the other checks to reject.
+func checkZipSize(ra io.ReaderAt, size int64, limit int64) error {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return nil
+	}
+
+	var uncompressed, compressed uint64
+	for _, f := range zr.File {
+		uncompressed += f.UncompressedSize64
+		compressed += f.CompressedSize64
+	}
+
+	if uncompressed > uint64(limit) {
+		return fmt.Errorf("is too big when decompressed: %d bytes exceeds the limit of %d bytes", uncompressed, limit)
+	}
+
+	if uncompressed > max(compressed, 1)*maxZipCompressionRatio {
+		return fmt.Errorf("has a suspicious compression ratio of more than %d to 1", maxZipCompressionRatio)
+	}
+
+	return nil
+}
+
+// allowsOfficeFileTypes reports whether t.AllowedFileTypes lists any Office Open XML document type, in
+// which case uploaded zip archives are inspected to detect them
+func (t *Tools) allowsOfficeFileTypes() bool {
+	return slices.ContainsFunc(t.AllowedFileTypes, func(ft string) bool {
+		return strings.HasPrefix(strings.ToLower(ft), "application/vnd.openxmlformats-officedocument.")
+	})
+}
+
+// SanitizeFilename returns name made safe to be used as a file name: directory components are removed,
+// as well as leading dots that would make the file hidden, and any character other than letters, digits,
+// dots, dashes and underscores is replaced by an underscore, or dropped at the start and end of the name.
+// The extension is preserved. UploadFiles uses
+// it for the files it does not rename.
+func (t *Tools) SanitizeFilename(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	allowed := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_'
+	}
+
+	// characters that would be replaced are dropped at the edges instead, while underscores written by
+	// the user, as in "__init__.py", are kept
+	name = strings.TrimLeftFunc(name, func(r rune) bool { return r == '.' || !allowed(r) })
+	name = strings.TrimRightFunc(name, func(r rune) bool { return !allowed(r) })
+
+	var b strings.Builder
+	underscore := false
+	for _, r := range name {
+		if allowed(r) {
+			b.WriteRune(r)
+			underscore = r == '_'
+			continue
+		}
+
+		if !underscore {
+			b.WriteRune('_')
+			underscore = true
+		}
+	}
+
+	sanitized := b.String()
+	if strings.Trim(sanitized, ".") == "" {
+		return "file"
+	}
+
+	return sanitized
+}
+
+// truncateFilename shortens name to at most maxLength bytes, keeping its extension unless the extension
+// alone does not fit. Names are cut at a rune boundary.
+func truncateFilename(name string, maxLength int) string {
+	if len(name) <= maxLength {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) >= maxLength {
+		ext = ""
+	}
+
+	base := name[:len(name)-len(ext)]
+	return cutAtRune(base, maxLength-len(ext)) + ext
+}
+
+// cutAtRune shortens s to at most n bytes, without splitting a rune
+func cutAtRune(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
+
+// extensionAllowed checks the extension of filename against t.BlockedExtensions and t.AllowedExtensions,
+// case-insensitively and with or without the leading dot. Blocked extensions take precedence, and any
+// extension is allowed when t.AllowedExtensions is empty.
+func (t *Tools) extensionAllowed(filename string) bool {
+	ext := strings.TrimPrefix(filepath.Ext(filename), ".")
+	matches := func(e string) bool {
+		return strings.EqualFold(strings.TrimPrefix(e, "."), ext)
+	}
+
+	if slices.ContainsFunc(t.BlockedExtensions, matches) {
+		return false
+	}
+
+	return len(t.AllowedExtensions) == 0 || slices.ContainsFunc(t.AllowedExtensions, matches)
+}
+
+// IsAllowedFileType reports whether contentType is allowed by t.AllowedFileTypes, using the same
+// case-insensitive and wildcard-aware matching as UploadFiles. Any type is allowed when the list is empty.
+func (t *Tools) IsAllowedFileType(contentType string) bool {
+	if len(t.AllowedFileTypes) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(t.AllowedFileTypes, func(ft string) bool {
+		return fileTypeMatches(contentType, ft)
+	})
+}
+
+// fileTypeMatches reports whether contentType matches the allowed type pattern, case-insensitively.
+// The pattern may be an exact MIME type or a wildcard such as "image/*" or "*/*".
+func fileTypeMatches(contentType, pattern string) bool {
+	if strings.EqualFold(contentType, pattern) || pattern == "*/*" {
+		return true
+	}
+
+	patternType, ok := strings.CutSuffix(pattern, "/*")
+	if !ok {
+		return false
+	}
+
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	detectedType, _, _ := strings.Cut(strings.TrimSpace(mediaType), "/")
+
+	return strings.EqualFold(detectedType, patternType)
+}
+
+// extensionMatchesContentType reports whether the MIME type registered for the extension of
+// filename matches contentType, ignoring any media type parameters.
+func extensionMatchesContentType(filename, contentType string) bool {
+	byExtension := mime.TypeByExtension(filepath.Ext(filename))
+	if byExtension == "" {
+		return false
+	}
+
+	extType, _, err := mime.ParseMediaType(byExtension)
+	if err != nil {
+		return false
+	}
+
+	detectedType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(extType, detectedType)
+}
+
+// ErrNotDirectory is returned by CreateDirIfNotExists when the path already exists but is not a directory.
+var ErrNotDirectory = errors.New("path exists but is not a directory")
+
+// CreateDirIfNotExists creates a dir if it does not exist
+func (t *Tools) CreateDirIfNotExists(path string, mode os.FileMode) error {
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		return fmt.Errorf("%s: %w", path, ErrNotDirectory)
+	}
+
+	if err := os.MkdirAll(path, mode); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CopyDir recursively copies the directory tree at src into dst, creating directories with the given mode
+// and copying the contents and permissions of regular files. dst may already exist, in which case
+// existing files with the same names are overwritten. Symbolic links are skipped. dst must not be src itself
+// or lie inside it, since the copy would then keep walking into its own output.
+func (t *Tools) CopyDir(src, dst string, mode os.FileMode) error {
+	absSrc, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	absDst, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(absSrc, absDst); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("cannot copy %s into itself (%s)", src, dst)
+	}
+
+	return filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case d.IsDir():
+			return t.CreateDirIfNotExists(target, mode)
+		case d.Type()&os.ModeSymlink != 0:
+			return nil
+		case !d.Type().IsRegular():
+			return nil
+		}
+
+		return copyFile(path, target)
+	})
+}
+
+// RemoveDirContents deletes everything inside the directory at path, while keeping the directory itself,
+// along with its permissions and ownership.
+func (t *Tools) RemoveDirContents(path string) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(path, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DirSize returns the total size in bytes of the regular files in the directory tree at path,
+// which is useful for enforcing upload quotas.
+func (t *Tools) DirSize(path string) (int64, error) {
+	var size int64
+
+	err := filepath.WalkDir(path, func(_ string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// copyFile copies the contents and permissions of the regular file src to dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// slugTransliterator maps accented and special Latin characters to their ASCII equivalents, so that
+// Slugfy keeps them as letters instead of stripping them
+var slugTransliterator = strings.NewReplacer(
+	"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a", "ā", "a", "ă", "a", "ą", "a",
+	"ç", "c", "ć", "c", "č", "c", "ĉ", "c", "ċ", "c",
+	"ď", "d", "đ", "d", "ð", "d",
+	"è", "e", "é", "e", "ê", "e", "ë", "e", "ē", "e", "ė", "e", "ę", "e", "ě", "e",
+	"ğ", "g", "ģ", "g",
+	"ì", "i", "í", "i", "î", "i", "ï", "i", "ī", "i", "į", "i", "ı", "i",
+	"ķ", "k",
+	"ĺ", "l", "ļ", "l", "ľ", "l", "ł", "l",
+	"ñ", "n", "ń", "n", "ņ", "n", "ň", "n",
+	"ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o", "ō", "o", "ő", "o",
+	"ŕ", "r", "ř", "r",
+	"ś", "s", "š", "s", "ş", "s", "ș", "s",
+	"ť", "t", "ţ", "t", "ț", "t",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u", "ū", "u", "ů", "u", "ű", "u", "ų", "u",
+	"ý", "y", "ÿ", "y",
+	"ź", "z", "ż", "z", "ž", "z",
+	"ß", "ss", "æ", "ae", "œ", "oe", "þ", "th",
+)
+
+// Slugfy creates a simple slug from a string, joining words with t.SlugSeparator ("-" by default)
+func (t *Tools) Slugfy(s string) (string, error) {
+	if s == "" {
+		return "", errors.New("empty string not allowed")
+	}
+
+	re := regexp.MustCompile(`[^a-z\d]+`)
+	separator := t.slugSeparator()
+	slug := strings.Trim(re.ReplaceAllLiteralString(slugTransliterator.Replace(strings.ToLower(s)), separator), separator)
+	if len(slug) == 0 {
+		return "", errors.New("empty string, after slug process")
+	}
+
+	if t.MaxSlugLength > 0 && len(slug) > t.MaxSlugLength {
+		slug = truncateSlug(slug, t.MaxSlugLength, separator)
+		if len(slug) == 0 {
+			return "", fmt.Errorf("empty string, after truncating the slug to %d bytes", t.MaxSlugLength)
+		}
+	}
+
+	return slug, nil
+}
+
+// SlugfyUnicode creates a slug from a string just like Slugfy, but keeps any Unicode letter or digit
+// instead of only a-z and 0-9, so non-Latin text such as "привет мир" becomes "привет-мир". Combining marks
+// that follow a letter or digit, such as the vowel signs of Devanagari, are kept as part of the word.
+func (t *Tools) SlugfyUnicode(s string) (string, error) {
+	if s == "" {
+		return "", errors.New("empty string not allowed")
+	}
+
+	separator := t.slugSeparator()
+	var b strings.Builder
+	pending := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsMark(r) && b.Len() > 0 && !pending {
+			b.WriteRune(r)
+			continue
+		}
+
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			pending = b.Len() > 0
+			continue
+		}
+
+		if pending {
+			b.WriteString(separator)
+			pending = false
+		}
+		b.WriteRune(r)
+	}
+
+	slug := b.String()
+	if len(slug) == 0 {
+		return "", errors.New("empty string, after slug process")
+	}
+
+	if t.MaxSlugLength > 0 && len(slug) > t.MaxSlugLength {
+		slug = truncateSlug(slug, t.MaxSlugLength, separator)
+		if len(slug) == 0 {
+			return "", fmt.Errorf("empty string, after truncating the slug to %d bytes", t.MaxSlugLength)
+		}
+	}
+
+	return slug, nil
+}
+
+// SlugfyUnique creates a slug from s just like Slugfy and, if a file named after the slug with extension ext
+// already exists in dir, appends "-2", "-3" and so on until the name is unused. The returned slug does not
+// include the extension.
+func (t *Tools) SlugfyUnique(s string, dir string, ext string) (string, error) {
+	slug, err := t.Slugfy(s)
+	if err != nil {
+		return "", err
+	}
+
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+
+	candidate := slug
+	for i := 2; ; i++ {
+		_, err := os.Stat(filepath.Join(dir, candidate+ext))
+		if errors.Is(err, os.ErrNotExist) {
+			return candidate, nil
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		candidate = fmt.Sprintf("%s%s%d", slug, t.slugSeparator(), i)
+	}
+}
+
+// SlugfyBatch creates a slug for each of inputs just like Slugfy, preserving their order, and makes them
+// unique within the batch by appending "-2", "-3" and so on to repeated slugs. It fails on the first input
+// that can't be slugified.
+func (t *Tools) SlugfyBatch(inputs []string) ([]string, error) {
+	slugs := make([]string, len(inputs))
+	used := make(map[string]bool, len(inputs))
+
+	for i, s := range inputs {
+		slug, err := t.Slugfy(s)
+		if err != nil {
+			return nil, fmt.Errorf("input %d: %w", i, err)
+		}
+
+		candidate := slug
+		for n := 2; used[candidate]; n++ {
+			candidate = fmt.Sprintf("%s%s%d", slug, t.slugSeparator(), n)
+		}
+
+		used[candidate] = true
+		slugs[i] = candidate
+	}
+
+	return slugs, nil
+}
+
+// slugSeparator returns t.SlugSeparator, or "-" when none is set
+func (t *Tools) slugSeparator() string {
+	if t.SlugSeparator != "" {
+		return t.SlugSeparator
+	}
+	return "-"
+}
+
+// truncateSlug shortens slug to at most maxLength bytes, cutting at the last separator that fits so
+// that no word is split. A single word longer than maxLength is hard-truncated at a rune boundary.
+func truncateSlug(slug string, maxLength int, separator string) string {
+	if len(slug) <= maxLength {
+		return slug
+	}
+
+	for maxLength > 0 && !utf8.RuneStart(slug[maxLength]) {
+		maxLength--
+	}
+
+	if strings.HasPrefix(slug[maxLength:], separator) {
+		return strings.TrimRight(slug[:maxLength], separator)
+	}
+
+	cut := slug[:maxLength]
+	if i := strings.LastIndex(cut, separator); i > 0 {
+		cut = cut[:i]
+	}
+
+	return strings.TrimRight(cut, separator)
+}
+
+// DownloadStaticFile downloads a file, and tries to force the browser to avoid displaying it
+// in the browser window by setting content disposition. It also allows specification of
+// the display name. If the optional inline parameter is true, the file is served with an inline
+// disposition instead, so the browser may preview it. Range and conditional requests are supported, using
+// an ETag computed from the file size and modification time.
+// Files resolving outside of the directory p are rejected with 400 Bad Request. If DownloadSecret is set,
+// requests without a valid URL signature created by SignedURL are rejected with 403 Forbidden.
+// The Content-Type is taken from ContentTypeOverrides when it has an entry for the file extension,
+// such as ".geojson", and is otherwise inferred by http.ServeFile.
+func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, p, file, displayName string, inline ...bool) {
+	if t.DownloadSecret != "" {
+		if ok, err := t.VerifySignedURL(r.URL.RequestURI(), t.DownloadSecret); !ok {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	disposition := "attachment"
+	if len(inline) > 0 && inline[0] {
+		disposition = "inline"
+	}
+
+	filePath, err := safeJoin(p, file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=\"%s\"", disposition, displayName))
+
+	if contentType, ok := t.ContentTypeOverrides[strings.ToLower(filepath.Ext(filePath))]; ok {
+		w.Header().Set("Content-Type", contentType)
+	}
+
+	// http.ServeFile answers If-None-Match with 304 Not Modified when the ETag header is set
+	if info, err := os.Stat(filePath); err == nil && info.Mode().IsRegular() {
+		w.Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size()))
+	}
+
+	http.ServeFile(w, r, filePath)
+}
+
+// SignedURL returns path with "expires" and "signature" query parameters added, signing the path, its query
+// and the expiry time with an HMAC-SHA256 of secret, so that none of them can be changed. VerifySignedURL checks the returned URL until expiry, which
+// allows sharing time-limited download links without keeping any state on the server.
+func (t *Tools) SignedURL(path string, secret string, expiry time.Time) string {
+	u, err := url.Parse(path)
+	if err != nil {
+		u = &url.URL{Path: path}
+	}
+
+	expires := strconv.FormatInt(expiry.Unix(), 10)
+
+	q := u.Query()
+	q.Set("expires", expires)
+	q.Set("signature", urlSignature(u.Path, q, secret))
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+// VerifySignedURL reports whether rawURL carries a valid, unexpired signature created by SignedURL with
+// the same secret. When it doesn't, the returned error tells why.
+func (t *Tools) VerifySignedURL(rawURL string, secret string) (bool, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false, err
+	}
+
+	q := u.Query()
+	expires, signature := q.Get("expires"), q.Get("signature")
+	if expires == "" || signature == "" {
+		return false, errors.New("url is not signed")
+	}
+
+	expiry, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return false, errors.New("invalid url expiry")
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(urlSignature(u.Path, q, secret))) {
+		return false, errors.New("invalid url signature")
+	}
+
+	if time.Now().Unix() > expiry {
+		return false, errors.New("signed url has expired")
+	}
+
+	return true, nil
+}
+
+// urlSignature returns the hex HMAC-SHA256 of path and the query q using secret. The query is encoded
+// sorted by key and without its signature parameter, so that the order of the parameters doesn't matter.
+func urlSignature(path string, q url.Values, secret string) string {
+	q = maps.Clone(q)
+	delete(q, "signature")
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(path + "\n" + q.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DownloadStream sends the data read from content to the client as a file download named displayName,
+// which is handy for files generated on the fly such as CSV exports. If contentType is empty,
+// application/octet-stream is used. The optional size parameter sets the Content-Length header.
+func (t *Tools) DownloadStream(w http.ResponseWriter, r *http.Request, content io.Reader, displayName, contentType string, size ...int64) error {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", displayName))
+	w.Header().Set("Content-Type", contentType)
+	if len(size) > 0 && size[0] >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size[0], 10))
+	}
+
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	_, err := io.Copy(w, content)
+	return err
+}
+
+// DownloadBytes sends data to the client as a file download named displayName, for generated exports held
+// in memory. The optional contentType parameter sets the Content-Type header, which otherwise is detected
+// from data with http.DetectContentType.
+func (t *Tools) DownloadBytes(w http.ResponseWriter, data []byte, displayName string, contentType ...string) error {
+	ct := http.DetectContentType(data)
+	if len(contentType) > 0 && contentType[0] != "" {
+		ct = contentType[0]
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", displayName))
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+
+	_, err := w.Write(data)
+	return err
+}
+
+// StaticOptions configures StaticHandler
+type StaticOptions struct {
+	// AllowDotfiles serves files and directories whose name starts with a dot, such as .env or .git
+	AllowDotfiles bool
+}
+
+// StaticHandler returns a handler serving the files in dir like http.FileServer, but safer for static
+// assets: directories are only served through their index.html, never listed, and dotfiles are hidden
+// unless opts allows them. Both cases respond with 404 Not Found.
+func (t *Tools) StaticHandler(dir string, opts ...StaticOptions) http.Handler {
+	var options StaticOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+
+	fileServer := http.FileServer(http.Dir(dir))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+
+		if !options.AllowDotfiles && slices.ContainsFunc(strings.Split(name, "/"), func(part string) bool {
+			return strings.HasPrefix(part, ".")
+		}) {
+			http.NotFound(w, r)
+			return
+		}
+
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if err == nil && info.IsDir() {
+			if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name), "index.html")); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// safeJoin joins file to the base directory p, returning an error if the resulting path escapes p
+func safeJoin(p, file string) (string, error) {
+	base, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+
+	filePath, err := filepath.Abs(filepath.Join(base, file))
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(base, filePath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("invalid file path")
+	}
+
+	return filePath, nil
+}
+
+// JSONResponse is the type fo sending json around
+type JSONResponse struct {
+	Error   bool        `json:"error"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+	Meta    interface{} `json:"meta,omitempty"`
+}
+
+func (j JSONResponse) Prepare(err error, status int) interface{} {
+	return JSONResponse{
+		Error:   true,
+		Message: err.Error(),
+		Data:    status,
+	}
+}
+
+// JSONErrorKind identifies why ReadJSON could not decode a request body
+type JSONErrorKind int
+
+const (
+	// JSONErrorSyntax means the body is not well-formed JSON
+	JSONErrorSyntax JSONErrorKind = iota + 1
+	// JSONErrorType means a JSON value does not match the type of the destination field
+	JSONErrorType
+	// JSONErrorTooLarge means the body exceeds MaxJSONSize
+	JSONErrorTooLarge
+	// JSONErrorEmpty means the body is empty
+	JSONErrorEmpty
+	// JSONErrorUnknownField means the body has a key not present in the destination and AllowUnknownFields is false
+	JSONErrorUnknownField
+	// JSONErrorMultiple means the body has more than one JSON value
+	JSONErrorMultiple
+	// JSONErrorTooDeep means the body has objects or arrays nested deeper than MaxJSONDepth
+	JSONErrorTooDeep
+	// JSONErrorMissingField means the body lacks a key required by ReadJSONRequire
+	JSONErrorMissingField
+	// JSONErrorTimeout means the body was not read within the timeout given to ReadJSONTimeout
+	JSONErrorTimeout
+	// JSONErrorContentType means the Content-Type of the request is not application/json and
+	// RequireJSONContentType is true. It maps to 415 Unsupported Media Type.
+	JSONErrorContentType
+)
+
+// JSONError is returned by ReadJSON when the request body can't be decoded. Kind can be used to map
+// the error to an HTTP status, while Error returns a human-readable message.
+type JSONError struct {
+	Kind    JSONErrorKind
+	Message string
+	Err     error
+}
+
+func (e *JSONError) Error() string {
+	return e.Message
+}
+
+func (e *JSONError) Unwrap() error {
+	return e.Err
+}
+
+// ReadJSON tries to read the body os a request and converts from json to a go data variable.
+// The data parameter takes a pointer of any kind as argument. Decoding failures are reported as *JSONError.
+// Bodies sent with Content-Encoding: gzip are decompressed before decoding. If MaxJSONDepth is set, bodies
+// nesting objects and arrays deeper than it are rejected before being decoded. If RequireJSONContentType is
+// set, requests whose Content-Type is not application/json are rejected without reading the body.
+func (t *Tools) ReadJSON(w http.ResponseWriter, r *http.Request, data interface{}) error {
+	if err := t.checkJSONContentType(r); err != nil {
+		return err
+	}
+
+	// 1. Set file limit
+	maxBytes := t.maxJSONBytes()
+
+	// 2. Read body with the limit set
+	body, err := t.jsonBody(w, r, maxBytes)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return t.DecodeJSON(body, data, DecodeOptions{MaxBytes: maxBytes})
+}
+
+// DecodeOptions configures DecodeJSON
+type DecodeOptions struct {
+	// MaxBytes limits the size of the JSON read, defaulting to MaxJSONSize
+	MaxBytes int
+	// AllowUnknownFields accepts keys that match no field of data, like Tools.AllowUnknownFields does
+	AllowUnknownFields bool
+}
+
+// DecodeJSON decodes the single JSON value read from r into data with the same strict rules as ReadJSON,
+// but from any reader, such as a file or a message. Unknown keys, trailing data, bodies larger than
+// MaxJSONSize and, if MaxJSONDepth is set, bodies nested too deep are rejected, unless opts say otherwise.
+// Decoding failures are reported as *JSONError.
+func (t *Tools) DecodeJSON(r io.Reader, data interface{}, opts ...DecodeOptions) error {
+	maxBytes := t.maxJSONBytes()
+	allowUnknownFields := t.AllowUnknownFields
+	if len(opts) > 0 {
+		if opts[0].MaxBytes > 0 {
+			maxBytes = opts[0].MaxBytes
+		}
+		allowUnknownFields = allowUnknownFields || opts[0].AllowUnknownFields
+	}
+
+	body := http.MaxBytesReader(nil, io.NopCloser(r), int64(maxBytes))
+
+	return t.decodeJSON(body, data, maxBytes, allowUnknownFields)
+}
+
+// ReadJSONTimeout reads JSON from the body of a request into data just like ReadJSON, but gives up if the
+// body can't be read within timeout, which mitigates slow clients holding the handler by sending the body
+// byte by byte. A timeout is reported as a *JSONError of kind JSONErrorTimeout wrapping
+// context.DeadlineExceeded. When supported, the read deadline of the connection is set as well.
+func (t *Tools) ReadJSONTimeout(w http.ResponseWriter, r *http.Request, data interface{}, timeout time.Duration) error {
+	if err := t.checkJSONContentType(r); err != nil {
+		return err
+	}
+
+	maxBytes := t.maxJSONBytes()
+
+	rc := http.NewResponseController(w)
+	deadlineSet := rc.SetReadDeadline(time.Now().Add(timeout)) == nil
+
+	body, err := t.jsonBody(w, r, maxBytes)
+	if err != nil {
+		return err
+	}
+
+	type result struct {
+		raw []byte
+		err error
+	}
+
+	// The body is read in the background so that a blocked read can't outlive the timeout. It's decoded
+	// here, so that data is never written to after returning. Canceling readCtx stops the reads.
+	readCtx, stopReading := context.WithCancel(context.Background())
+	defer stopReading()
+
+	done := make(chan result, 1)
+	go func() {
+		raw, err := io.ReadAll(contextReader{ctx: readCtx, r: body})
+		done <- result{raw: raw, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	timeoutErr := &JSONError{Kind: JSONErrorTimeout, Message: fmt.Sprintf("body was not read within %s", timeout), Err: context.DeadlineExceeded}
+
+	select {
+	case res := <-done:
+		body.Close()
+		if deadlineSet {
+			_ = rc.SetReadDeadline(time.Time{})
+		}
+
+		if errors.Is(res.err, os.ErrDeadlineExceeded) {
+			return timeoutErr
+		}
+		if res.err != nil {
+			return decodeJSONError(res.err, maxBytes)
+		}
+		return t.decodeJSON(bytes.NewReader(res.raw), data, maxBytes, t.AllowUnknownFields)
+
+	case <-timer.C:
+		// The expired read deadline, if any, stays in place to unblock the background read. Otherwise, closing
+		// the body unblocks it. That's done in the background, since some bodies, like those of server
+		// requests, only close once the pending read returns.
+		stopReading()
+		go body.Close()
+		return timeoutErr
+	}
+}
+
+// decodeJSON decodes the single JSON value read from body into data, applying allowUnknownFields and
+// MaxJSONDepth. maxBytes is the limit body was read with, used in error messages.
+func (t *Tools) decodeJSON(body io.Reader, data interface{}, maxBytes int, allowUnknownFields bool) error {
+	src := body
+	if t.MaxJSONDepth > 0 {
+		raw, err := io.ReadAll(body)
+		if err != nil {
+			return decodeJSONError(err, maxBytes)
+		}
+
+		if err := checkJSONDepth(raw, t.MaxJSONDepth); err != nil {
+			return err
+		}
+		src = bytes.NewReader(raw)
+	}
+
+	// 3. Create new JSON decoder
+	dec := json.NewDecoder(src)
+
+	if !allowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+
+	// 4. Decode data
+	if err := dec.Decode(data); err != nil {
+		return decodeJSONError(err, maxBytes)
+	}
+
+	// 5. Set safety condition
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return &JSONError{Kind: JSONErrorMultiple, Message: "body must contain only one JSON value", Err: err}
+	}
+
+	return nil
+}
+
+// checkJSONDepth walks the tokens of data and returns a *JSONError if objects and arrays are nested deeper
+// than maxDepth. Malformed JSON is left for the decoder to report.
+func checkJSONDepth(data []byte, maxDepth int) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if depth > maxDepth {
+				return &JSONError{Kind: JSONErrorTooDeep, Message: fmt.Sprintf("body must not be nested deeper than %d levels", maxDepth)}
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+// Validator is implemented by types that can check their own fields after being decoded
+type Validator interface {
+	Validate() error
+}
+
+// ReadJSONValidated reads JSON from the body of a request into data just like ReadJSON and then, if data
+// implements Validator, returns the error of its Validate method.
+func (t *Tools) ReadJSONValidated(w http.ResponseWriter, r *http.Request, data interface{}) error {
+	if err := t.ReadJSON(w, r, data); err != nil {
+		return err
+	}
+
+	if v, ok := data.(Validator); ok {
+		return v.Validate()
+	}
+
+	return nil
+}
+
+// ReadJSONRequire reads JSON from the body of a request into data just like ReadJSON, but first checks that
+// the body is an object containing every one of the required top-level keys, even if their value is null.
+// The error for a missing key is a *JSONError of kind JSONErrorMissingField naming the first one missing.
+func (t *Tools) ReadJSONRequire(w http.ResponseWriter, r *http.Request, data interface{}, required ...string) error {
+	var raw json.RawMessage
+	if err := t.ReadJSON(w, r, &raw); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil || fields == nil {
+		return &JSONError{Kind: JSONErrorType, Message: "body must be a JSON object", Err: err}
+	}
+
+	for _, key := range required {
+		if _, ok := fields[key]; !ok {
+			return &JSONError{Kind: JSONErrorMissingField, Message: fmt.Sprintf("body is missing required key %q", key)}
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if !t.AllowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+
+	if err := dec.Decode(data); err != nil {
+		return decodeJSONError(err, t.maxJSONBytes())
+	}
+
+	return nil
+}
+
+// ReadJSONStream reads a sequence of JSON values from the body of a request, such as concatenated or
+// newline-delimited objects sent to bulk import endpoints, and calls fn with each of them in order.
+// Reading stops at the first error returned by fn. The whole body is limited to MaxJSONSize bytes.
+func (t *Tools) ReadJSONStream(w http.ResponseWriter, r *http.Request, fn func(item json.RawMessage) error) error {
+	if err := t.checkJSONContentType(r); err != nil {
+		return err
+	}
+
+	maxBytes := t.maxJSONBytes()
+
+	body, err := t.jsonBody(w, r, maxBytes)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	dec := json.NewDecoder(body)
+
+	for count := 0; ; count++ {
+		var item json.RawMessage
+		err := dec.Decode(&item)
+		if errors.Is(err, io.EOF) && count > 0 {
+			return nil
+		}
+
+		if err != nil {
+			return decodeJSONError(err, maxBytes)
+		}
+
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+}
+
+// DecodeJSONArray reads a JSON array from the body of r one element at a time, calling fn with each of
+// them in order, so that huge arrays sent to bulk import endpoints never have to be held in memory at once.
+// Reading stops at the first error returned by fn. The whole body is limited to MaxJSONSize bytes.
+func (t *Tools) DecodeJSONArray(r *http.Request, fn func(json.RawMessage) error) error {
+	if err := t.checkJSONContentType(r); err != nil {
+		return err
+	}
+
+	maxBytes := t.maxJSONBytes()
+
+	body, err := t.jsonBody(nil, r, maxBytes)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	dec := json.NewDecoder(body)
+
+	tok, err := dec.Token()
+	if err != nil {
+		return decodeJSONError(err, maxBytes)
+	}
+
+	if tok != json.Delim('[') {
+		return &JSONError{Kind: JSONErrorType, Message: "body must be a JSON array"}
+	}
+
+	for dec.More() {
+		var item json.RawMessage
+		if err := dec.Decode(&item); err != nil {
+			return decodeJSONError(err, maxBytes)
+		}
+
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+
+	// consume the closing bracket, which is missing if the body ends early
+	if _, err := dec.Token(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return decodeJSONError(err, maxBytes)
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return &JSONError{Kind: JSONErrorMultiple, Message: "body must contain only one JSON value", Err: err}
+	}
+
+	return nil
+}
+
+// checkJSONContentType returns a *JSONError of kind JSONErrorContentType if t.RequireJSONContentType is
+// true and the Content-Type of r is not application/json, parameters such as charset aside.
+func (t *Tools) checkJSONContentType(r *http.Request) error {
+	if !t.RequireJSONContentType {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return &JSONError{Kind: JSONErrorContentType, Message: "Content-Type header must be application/json", Err: err}
+	}
+
+	return nil
+}
+
+// jsonBody limits the body of r to maxBytes and returns it, transparently decompressing bodies sent with
+// Content-Encoding: gzip. For those, the limit applies to the decompressed data as well.
+func (t *Tools) jsonBody(w http.ResponseWriter, r *http.Request, maxBytes int) (io.ReadCloser, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	if !strings.EqualFold(strings.TrimSpace(r.Header.Get("Content-Encoding")), "gzip") {
+		return r.Body, nil
+	}
+
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		r.Body.Close()
+		if errors.Is(err, io.EOF) {
+			return nil, &JSONError{Kind: JSONErrorEmpty, Message: "body must not be empty", Err: err}
+		}
+		return nil, &JSONError{Kind: JSONErrorSyntax, Message: "body contains invalid gzip data", Err: err}
+	}
+
+	return http.MaxBytesReader(w, gzipBody{Reader: gz, body: r.Body}, int64(maxBytes)), nil
+}
+
+// gzipBody reads decompressed data from a gzip.Reader and closes the underlying request body on Close
+type gzipBody struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (g gzipBody) Close() error {
+	return errors.Join(g.Reader.Close(), g.body.Close())
+}
+
+// maxJSONBytes returns the maximum JSON body size, MaxJSONSize or 1MB by default
+func (t *Tools) maxJSONBytes() int {
+	if t.MaxJSONSize > 0 {
+		return t.MaxJSONSize
+	}
+	return 1024 * 1024
+}
+
+// decodeJSONError converts an error returned by json.Decoder into a readable error, usually a *JSONError
+func decodeJSONError(err error, maxBytes int) error {
+	var (
+		syntaxError           *json.SyntaxError
+		unmarshalTypeError    *json.UnmarshalTypeError
+		invalidUnmarshalError *json.InvalidUnmarshalError
+		maxBytesError         *http.MaxBytesError
+	)
+
+	switch {
+	case errors.As(err, &syntaxError):
+		return &JSONError{Kind: JSONErrorSyntax, Message: fmt.Sprintf("body contains badly-formed JSON (at character %d)", syntaxError.Offset), Err: err}
+
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &JSONError{Kind: JSONErrorSyntax, Message: "body contains badly-formed JSON", Err: err}
+
+	case errors.As(err, &unmarshalTypeError):
+		return &JSONError{Kind: JSONErrorType, Message: fmt.Sprintf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field), Err: err}
+
+	case errors.Is(err, io.EOF):
+		return &JSONError{Kind: JSONErrorEmpty, Message: "body must not be empty", Err: err}
+
+	case strings.HasPrefix(err.Error(), "json: unknown field"):
+		fieldName := strings.TrimSpace(strings.TrimPrefix(err.Error(), "json: unknown field"))
+		// the field name comes quoted, and unquoting it keeps %q from escaping it twice
+		if unquoted, unquoteErr := strconv.Unquote(fieldName); unquoteErr == nil {
+			fieldName = unquoted
+		}
+		return &JSONError{Kind: JSONErrorUnknownField, Message: fmt.Sprintf("body contains unknown key %q", fieldName), Err: err}
+
+	case errors.As(err, &maxBytesError):
+		return &JSONError{Kind: JSONErrorTooLarge, Message: fmt.Sprintf("body must no be larger than %d bytes", maxBytes), Err: err}
+
+	case errors.As(err, &invalidUnmarshalError):
+		return fmt.Errorf("error unmarshaling JSON: %s", err.Error())
+
+	default:
+		return err
+	}
+}
+
+// WriteJSON takes a response status code and arbitrary data and writes json to the client.
+// The data parameter takes a pointer of any kind as argument.
+func (t *Tools) WriteJSON(w http.ResponseWriter, status int, data interface{}, headers ...http.Header) error {
+	// data is encoded to a buffer first, so that nothing is sent to the client if it can't be encoded.
+	var buf bytes.Buffer
+	if err := t.EncodeJSON(&buf, data); err != nil {
+		return err
+	}
+
+	if len(headers) > 0 {
+		maps.Copy(w.Header(), headers[0])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err := w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// WriteJSONCached writes data as JSON to the client like WriteJSON, along with an ETag header computed
+// from the encoded data. When r is a GET or HEAD request whose If-None-Match header matches the ETag,
+// only a 304 Not Modified status is sent, letting the client reuse its cached copy.
+func (t *Tools) WriteJSONCached(w http.ResponseWriter, r *http.Request, status int, data interface{}) error {
+	var buf bytes.Buffer
+	if err := t.EncodeJSON(&buf, data); err != nil {
+		return err
+	}
+	out := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+
+	etag := fmt.Sprintf("\"%x\"", sha256.Sum256(out))
+	w.Header().Set("ETag", etag)
+
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err := w.Write(out)
+	return err
+}
+
+// etagMatches reports whether the If-None-Match header value matches etag, using weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for candidate := range strings.SplitSeq(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// EncodeJSON encodes data as JSON to w, followed by a newline. Unlike WriteJSON, it can write to
+// any io.Writer, such as a file or a buffer.
+func (t *Tools) EncodeJSON(w io.Writer, data interface{}) error {
+	return json.NewEncoder(w).Encode(data)
+}
+
+// WriteJSONOK writes data to the client wrapped in a successful JSONResponse, with status 200 OK.
+func (t *Tools) WriteJSONOK(w http.ResponseWriter, data interface{}) error {
+	return t.WriteJSON(w, http.StatusOK, JSONResponse{
+		Error: false,
+		Data:  data,
+	})
+}
+
+// WriteJSONWithMeta writes data to the client wrapped in a successful JSONResponse with the given status,
+// attaching meta, such as pagination information, to its Meta field.
+func (t *Tools) WriteJSONWithMeta(w http.ResponseWriter, status int, data interface{}, meta interface{}) error {
+	return t.WriteJSON(w, status, JSONResponse{
+		Error: false,
+		Data:  data,
+		Meta:  meta,
+	})
+}
+
+// Paginate computes the offset and limit to query the items of page, along with the total number of
+// pages for totalItems. Pages start at 1 and page is clamped to the valid range, while a perPage of zero
+// or less defaults to 20.
+func (t *Tools) Paginate(page, perPage, totalItems int) (offset, limit, totalPages int) {
+	if perPage <= 0 {
+		perPage = defaultPerPage
+	}
+
+	if totalItems > 0 {
+		totalPages = (totalItems + perPage - 1) / perPage
+	}
+
+	page = min(page, totalPages)
+	page = max(page, 1)
+
+	return (page - 1) * perPage, perPage, totalPages
+}
+
+// WriteJSONError writes message to the client wrapped in an error JSONResponse, with the given status.
+func (t *Tools) WriteJSONError(w http.ResponseWriter, status int, message string) error {
+	return t.WriteJSON(w, status, JSONResponse{
+		Error:   true,
+		Message: message,
+	})
+}
+
+// ReadXML tries to read the body of a request and converts from xml to a go data variable, just like
+// ReadJSON does for json. The body is limited to MaxXMLSize bytes, or 1MB by default.
+func (t *Tools) ReadXML(w http.ResponseWriter, r *http.Request, data interface{}) error {
+	maxBytes := 1024 * 1024
+	if t.MaxXMLSize > 0 {
+		maxBytes = t.MaxXMLSize
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+	defer r.Body.Close()
+
+	if err := xml.NewDecoder(r.Body).Decode(data); err != nil {
+		return decodeXMLError(err, maxBytes)
+	}
+
+	return nil
+}
+
+// decodeXMLError converts an error returned by xml.Decoder into a readable error
+func decodeXMLError(err error, maxBytes int) error {
+	var (
+		syntaxError   *xml.SyntaxError
+		maxBytesError *http.MaxBytesError
+	)
+
+	switch {
+	case errors.As(err, &maxBytesError):
+		return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+
+	case errors.As(err, &syntaxError):
+		return fmt.Errorf("body contains badly-formed XML (at line %d): %s", syntaxError.Line, syntaxError.Msg)
+
+	case errors.Is(err, io.EOF):
+		return errors.New("body must not be empty")
+
+	default:
+		return fmt.Errorf("error unmarshaling XML: %w", err)
+	}
+}
+
+// WriteXML takes a response status code and arbitrary data and writes xml to the client, just like
+// WriteJSON does for json. The output is preceded by the standard XML header.
+func (t *Tools) WriteXML(w http.ResponseWriter, status int, data interface{}, headers ...http.Header) error {
+	out, err := xml.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if len(headers) > 0 {
+		maps.Copy(w.Header(), headers[0])
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, err = w.Write(append([]byte(xml.Header), out...))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// jsonpCallback matches the JavaScript identifiers, optionally dotted such as "app.cb", accepted by WriteJSONP
+var jsonpCallback = regexp.MustCompile(`^[a-zA-Z_$][a-zA-Z0-9_$]*(\.[a-zA-Z_$][a-zA-Z0-9_$]*)*$`)
+
+// WriteJSONP writes data as JSON wrapped in a call to the callback function, for legacy clients that
+// need JSONP. The callback must be a plain JavaScript identifier, so that it can't be used to inject
+// scripts; otherwise an error is returned and nothing is written.
+func (t *Tools) WriteJSONP(w http.ResponseWriter, status int, data any, callback string) error {
+	if !jsonpCallback.MatchString(callback) {
+		return fmt.Errorf("invalid JSONP callback %q", callback)
+	}
+
+	out, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, err = fmt.Fprintf(w, "%s(%s)", callback, out)
+	return err
+}
+
+// ErrorJSON is a convenience method for error handling and writing to JSON.
+// It receives a variadic status code, if none is passed Bad Request will be set as default.
+func (t *Tools) ErrorJSON(w http.ResponseWriter, err error, status ...int) error {
+	statusCode := http.StatusBadRequest
+
+	if len(status) > 0 {
+		statusCode = status[0]
+	}
+
+	var payload interface{}
+	if t.ErrorResponseTemplate != nil {
+		payload = t.ErrorResponseTemplate.Prepare(err, statusCode)
+	} else {
+		payload = JSONResponse{Error: true, Message: err.Error()}
+	}
+
+	return t.WriteJSON(w, statusCode, payload)
+}
+
+// PushJSONToRemote posts arbitrary data to some URL as JSON, and returns the response, status code and error, if any.
+// The final parameter, client, is optional. If none is specified, standard http.Client is set as default.
+func (t *Tools) PushJSONToRemote(uri string, data interface{}, client ...*http.Client) (*http.Response, int, error) {
+	// create json
+	out, err := json.Marshal(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// check for the custom http client
+	httpClient := &http.Client{}
+	if len(client) > 0 {
+		httpClient = client[0]
+	}
+
+	// build the request and set the header
+	request, err := http.NewRequest("POST", uri, bytes.NewBuffer(out))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	// call the remote uri
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	// send response back
+	return response, response.StatusCode, nil
+}
+
+// PushJSON posts arbitrary data as JSON to url using the request context ctx, and returns the
+// response, status code and error, if any. Optional headers are merged into the request headers.
+// The request is sent with t.HTTPClient, or http.DefaultClient when none is set.
+func (t *Tools) PushJSON(ctx context.Context, url string, data any, headers ...http.Header) (*http.Response, int, error) {
+	out, err := json.Marshal(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(out))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, h := range headers {
+		for key, values := range h {
+			for _, v := range values {
+				request.Header.Add(key, v)
+			}
+		}
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	httpClient := t.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, response.StatusCode, nil
+}
+
+// PushJSONWithRetry posts data as JSON to url just like PushJSON, making up to attempts tries when the
+// request fails with a network error or a 5xx response. The wait between tries starts at backoff and
+// doubles after each of them. It stops early, returning ctx.Err(), if ctx is canceled while waiting.
+// When every try gets a 5xx, the last response is returned so the caller can inspect it.
+func (t *Tools) PushJSONWithRetry(ctx context.Context, url string, data any, attempts int, backoff time.Duration) (*http.Response, int, error) {
+	attempts = max(attempts, 1)
+
+	for attempt := 1; ; attempt++ {
+		response, status, err := t.PushJSON(ctx, url, data)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			if response != nil {
+				response.Body.Close()
+			}
+			return nil, 0, ctxErr
+		}
+
+		if (err == nil && status < http.StatusInternalServerError) || attempt == attempts {
+			return response, status, err
+		}
+
+		if response != nil {
+			response.Body.Close()
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, 0, ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// BasicAuth is a middleware that protects next with HTTP Basic Authentication. Requests whose credentials
+// don't match username and password receive 401 Unauthorized with a WWW-Authenticate header for realm.
+func (t *Tools) BasicAuth(next http.Handler, username, password string, realm string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+
+		userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+		passMatch := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+
+		if !ok || !userMatch || !passMatch {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm))
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MaxBytes is a middleware that limits request bodies to n bytes, so that any read made by next past
+// that limit fails, regardless of the body format.
+func (t *Tools) MaxBytes(next http.Handler, n int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AllowMethods is a middleware that only calls next for requests made with one of methods. Other
+// requests receive 405 Method Not Allowed with an Allow header listing methods.
+func (t *Tools) AllowMethods(next http.Handler, methods ...string) http.Handler {
+	allow := strings.Join(methods, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(methods, r.Method) {
+			w.Header().Set("Allow", allow)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CORSOptions configures the CORS middleware
+type CORSOptions struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+}
+
+// CORS is a middleware that adds Cross-Origin Resource Sharing headers to responses for the origins in
+// opts.AllowedOrigins ("*" allows any origin). Preflight requests are answered with 204 No Content without
+// calling next. When opts.AllowedMethods is empty, GET, HEAD and POST are allowed. CORS panics if a
+// wildcard origin is combined with AllowCredentials, since browsers reject that combination.
+func (t *Tools) CORS(next http.Handler, opts CORSOptions) http.Handler {
+	allowAnyOrigin := slices.Contains(opts.AllowedOrigins, "*")
+	if allowAnyOrigin && opts.AllowCredentials {
+		panic("toolkit: CORS wildcard origin can't be combined with AllowCredentials")
+	}
+
+	methods := opts.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		w.Header().Add("Vary", "Origin")
+
+		allowed := allowAnyOrigin || slices.ContainsFunc(opts.AllowedOrigins, func(o string) bool {
+			return strings.EqualFold(o, origin)
+		})
+
+		if origin != "" && allowed {
+			if allowAnyOrigin {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+
+			if opts.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if preflight {
+				w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+				if len(opts.AllowedHeaders) > 0 {
+					w.Header().Set("Access-Control-Allow-Headers", strings.Join(opts.AllowedHeaders, ", "))
+				}
+			}
+		}
+
+		if preflight {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestIDKey is the context key under which RequestID stores the request ID
+type requestIDKey struct{}
+
+// maxRequestIDLength is the longest incoming X-Request-ID header reused by RequestID
+const maxRequestIDLength = 128
+
+// RequestID is a middleware that tags each request with a unique ID, reusing the incoming X-Request-ID
+// header when it is at most maxRequestIDLength printable ASCII characters without spaces, so that it can't
+// inject lines into logs. The ID is sent back in the X-Request-ID response header and stored in the request
+// context, from where it can be read with RequestIDFromContext.
+func (t *Tools) RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = t.RandomStringFromSource(32, "abcdefghijklmnopqrstuvwxyz0123456789")
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID reports whether id is a non-empty string of at most maxRequestIDLength printable ASCII
+// characters, spaces excluded
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RequestIDFromContext returns the request ID stored in ctx by the RequestID middleware, if any.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+// rateLimitWindow tracks the requests made by a client in the current window
+type rateLimitWindow struct {
+	start time.Time
+	count int
+}
+
+// RateLimit is a middleware that allows each client IP at most perMinute requests per one-minute window.
+// Clients exceeding the limit receive 429 Too Many Requests with a Retry-After header. Entries of clients
+// whose window expired are cleaned up periodically, so memory use doesn't grow unbounded. It panics if
+// perMinute is not positive, since such a limit would reject every request.
+func (t *Tools) RateLimit(next http.Handler, perMinute int) http.Handler {
+	if perMinute <= 0 {
+		panic(fmt.Sprintf("toolkit: RateLimit requires a positive number of requests per minute, got %d", perMinute))
+	}
+
+	const window = time.Minute
+
+	var (
+		mu          sync.Mutex
+		clients     = make(map[string]*rateLimitWindow)
+		lastCleanup = time.Now()
+	)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+
+		now := time.Now()
+
+		mu.Lock()
+		if now.Sub(lastCleanup) > window {
+			for key, c := range clients {
+				if now.Sub(c.start) > window {
+					delete(clients, key)
+				}
+			}
+			lastCleanup = now
+		}
+
+		c, ok := clients[ip]
+		if !ok || now.Sub(c.start) > window {
+			c = &rateLimitWindow{start: now}
+			clients[ip] = c
+		}
+		c.count++
+		exceeded := c.count > perMinute
+		retryAfter := c.start.Add(window).Sub(now)
+		mu.Unlock()
+
+		if exceeded {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TokenBucket is a thread-safe token bucket rate limiter for imperative use, such as throttling
+// background jobs. Create it with NewTokenBucket.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewTokenBucket returns a full TokenBucket holding up to burst tokens, refilled at rate tokens per second.
+func (t *Tools) NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+	}
+}
+
+// Allow takes a token from the bucket and reports whether one was available.
+func (b *TokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// gzipMinSize is the minimum response size, in bytes, the Gzip middleware compresses
+const gzipMinSize = 1024
+
+// Gzip is a middleware that compresses responses with gzip for clients that accept it. Responses smaller than
+// gzipMinSize, already encoded, partial, or with a content type that is already compressed (images, video,
+// audio and archives) are sent untouched. Strong ETags of compressed responses are made weak.
+func (t *Tools) Gzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.Close()
+
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header value allows gzip encoded responses
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.TrimSpace(coding)
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		q, found := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+		if !found {
+			return true
+		}
+
+		if v, err := strconv.ParseFloat(q, 64); err == nil && v > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// gzipResponseWriter buffers the beginning of a response until it knows whether it is worth compressing,
+// then either streams it through a gzip.Writer or writes it unchanged
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if !g.decided {
+		g.status = status
+	}
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.decided {
+		if g.gz != nil {
+			return g.gz.Write(p)
+		}
+		return g.ResponseWriter.Write(p)
+	}
+
+	g.buf = append(g.buf, p...)
+	if len(g.buf) >= gzipMinSize {
+		if err := g.decide(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// decide sends the response headers, choosing whether to compress the response, and writes the buffered data
+func (g *gzipResponseWriter) decide() error {
+	g.decided = true
+
+	h := g.Header()
+	if h.Get("Content-Type") == "" && len(g.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(g.buf))
+	}
+
+	// partial responses are left alone, since their Content-Range describes the uncompressed bytes
+	compress := len(g.buf) >= gzipMinSize &&
+		h.Get("Content-Encoding") == "" &&
+		g.status != http.StatusNoContent && g.status != http.StatusNotModified &&
+		g.status != http.StatusPartialContent && h.Get("Content-Range") == "" &&
+		!isCompressedContentType(h.Get("Content-Type"))
+
+	if compress {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		// the compressed body is not byte for byte the one a strong ETag identifies
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		g.ResponseWriter.WriteHeader(g.status)
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+		_, err := g.gz.Write(g.buf)
+		g.buf = nil
+		return err
+	}
+
+	g.ResponseWriter.WriteHeader(g.status)
+	_, err := g.ResponseWriter.Write(g.buf)
+	g.buf = nil
+	return err
+}
+
+// Flush sends any buffered data to the client, so streaming handlers keep working
+func (g *gzipResponseWriter) Flush() {
+	if !g.decided {
+		_ = g.decide()
+	}
+
+	if g.gz != nil {
+		_ = g.gz.Flush()
+	}
+
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, so that http.ResponseController can reach features
+// such as read and write deadlines through the middleware
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// Close writes whatever is still buffered and finishes the gzip stream
+func (g *gzipResponseWriter) Close() error {
+	if !g.decided {
+		if err := g.decide(); err != nil {
+			return err
+		}
+	}
+
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+
+	return nil
+}
+
+// isCompressedContentType reports whether contentType is a format that is already compressed
+func isCompressedContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "audio/"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/zip", "application/gzip", "application/x-gzip", "application/x-bzip2",
+		"application/x-7z-compressed", "application/x-rar-compressed", "application/zstd":
+		return true
+	}
+
+	return false
+}
+
+// RecoverJSON is a middleware that recovers from panics in next, logs them along with the stack trace
+// through the configured logger, and answers with a 500 Internal Server Error JSONResponse.
+func (t *Tools) RecoverJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			t.logger().Error("panic recovered", "error", rec, "method", r.Method, "path", r.URL.Path, "stack", string(debug.Stack()))
+
+			_ = t.WriteJSON(w, http.StatusInternalServerError, JSONResponse{
+				Error:   true,
+				Message: http.StatusText(http.StatusInternalServerError),
+			})
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HealthCheckFailure describes a failing check in the response of HealthHandler. Check is the position
+// of the check in the list passed to HealthHandler, starting at 1.
+type HealthCheckFailure struct {
+	Check int    `json:"check"`
+	Error string `json:"error"`
+}
+
+// HealthHandler returns a handler for load balancer health endpoints that runs every check on each request.
+// When all of them pass it responds 200 OK, otherwise 503 Service Unavailable listing the failing checks
+// as []HealthCheckFailure in the data of a JSONResponse.
+func (t *Tools) HealthHandler(checks ...func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var failures []HealthCheckFailure
+		for i, check := range checks {
+			if err := check(); err != nil {
+				failures = append(failures, HealthCheckFailure{Check: i + 1, Error: err.Error()})
+			}
+		}
+
+		if len(failures) > 0 {
+			_ = t.WriteJSON(w, http.StatusServiceUnavailable, JSONResponse{
+				Error:   true,
+				Message: fmt.Sprintf("%d of %d health checks failed", len(failures), len(checks)),
+				Data:    failures,
+			})
+			return
+		}
+
+		_ = t.WriteJSON(w, http.StatusOK, JSONResponse{Message: "ok"})
+	})
+}
+
+// GetIP returns the IP address of the client that made r. X-Forwarded-For and X-Real-IP are only honored
+// when the immediate peer is one of trustedProxies, which may hold IP addresses or CIDR ranges, so that
+// clients can't spoof their address. Otherwise the host of r.RemoteAddr is returned.
+func (t *Tools) GetIP(r *http.Request, trustedProxies []string) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+
+	isTrusted := func(ip string) bool {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return false
+		}
+
+		for _, proxy := range trustedProxies {
+			if _, network, err := net.ParseCIDR(proxy); err == nil {
+				if network.Contains(addr) {
+					return true
+				}
+			} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !isTrusted(peer) {
+		return peer
+	}
+
+	// proxies may append their own header line instead of extending the first one, so all lines are joined
+	if forwarded := strings.Join(r.Header.Values("X-Forwarded-For"), ","); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+
+		// walk the chain from the closest hop, returning the first address not added by a trusted proxy
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+
+			if !isTrusted(hop) || i == 0 {
+				return hop
+			}
+		}
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+
+	return peer
 }
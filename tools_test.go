@@ -1,18 +1,40 @@
 package toolkit
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
+	"math/big"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -27,6 +49,189 @@ func TestTools_RandomString(t *testing.T) {
 
 }
 
+func TestTools_RandomStringFromSource(t *testing.T) {
+	testCases := []struct {
+		name   string
+		source string
+		allow  string
+	}{
+		{"hex alphabet", "0123456789abcdef", "0123456789abcdef"},
+		{"single character", "x", "x"},
+		{"empty source falls back to default", "", randStringSource},
+	}
+
+	var testTools Tools
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			str := testTools.RandomStringFromSource(50, tc.source)
+			if len(str) != 50 {
+				t.Errorf("expected 50 characters, got %d", len(str))
+			}
+
+			for _, c := range str {
+				if !strings.ContainsRune(tc.allow, c) {
+					t.Errorf("unexpected character %q in %s", c, str)
+				}
+			}
+		})
+	}
+
+	t.Run("RandomString uses configured source", func(t *testing.T) {
+		testTools := Tools{RandomStringSource: "ab"}
+		for _, c := range testTools.RandomString(50) {
+			if c != 'a' && c != 'b' {
+				t.Errorf("unexpected character %q", c)
+			}
+		}
+	})
+}
+
+func TestTools_RandomReadableString(t *testing.T) {
+	var testTools Tools
+
+	for range 1000 {
+		str := testTools.RandomReadableString(20)
+		if len(str) != 20 {
+			t.Fatalf("expected 20 characters, got %d", len(str))
+		}
+
+		if strings.ContainsAny(str, "0O1lIoiL") {
+			t.Fatalf("unexpected ambiguous character in %s", str)
+		}
+	}
+}
+
+func TestTools_RandomSecureString(t *testing.T) {
+	var testTools Tools
+
+	seen := make(map[string]bool)
+	for range 1000 {
+		str, err := testTools.RandomSecureStringE(32)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(str) != 32 {
+			t.Errorf("%s has %v letters", str, len(str))
+		}
+
+		for _, c := range str {
+			if !strings.ContainsRune(randStringSource, c) {
+				t.Errorf("unexpected character %q in %s", c, str)
+			}
+		}
+
+		if seen[str] {
+			t.Errorf("duplicated secure string generated: %s", str)
+		}
+		seen[str] = true
+	}
+
+	if str := testTools.RandomSecureString(10); len(str) != 10 {
+		t.Errorf("%s has %v letters", str, len(str))
+	}
+}
+
+func TestTools_RandomInt(t *testing.T) {
+	var testTools Tools
+
+	for _, random := range []struct {
+		name string
+		fn   func(low, high int) int
+	}{
+		{"RandomInt", testTools.RandomInt},
+		{"RandomSecureInt", testTools.RandomSecureInt},
+	} {
+		t.Run(random.name, func(t *testing.T) {
+			seen := make(map[int]bool)
+			for range 1000 {
+				n := random.fn(-3, 3)
+				if n < -3 || n >= 3 {
+					t.Fatalf("expected a value in [-3, 3), got %d", n)
+				}
+				seen[n] = true
+			}
+
+			if len(seen) != 6 {
+				t.Errorf("expected every value in range to be generated, got %v", seen)
+			}
+
+			if n := random.fn(7, 8); n != 7 {
+				t.Errorf("expected 7 for a single value range, got %d", n)
+			}
+
+			for range 100 {
+				if n := random.fn(-10, math.MaxInt); n < -10 {
+					t.Fatalf("expected a value in [-10, MaxInt), got %d", n)
+				}
+			}
+
+			random.fn(math.MinInt, math.MaxInt)
+		})
+	}
+}
+
+func TestTools_RandomInt_InvalidRange(t *testing.T) {
+	var testTools Tools
+
+	var tests = []struct {
+		name string
+		fn   func(low, high int) int
+		low  int
+		high int
+	}{
+		{"RandomInt equal bounds", testTools.RandomInt, 5, 5},
+		{"RandomInt inverted bounds", testTools.RandomInt, 10, 1},
+		{"RandomSecureInt equal bounds", testTools.RandomSecureInt, 5, 5},
+		{"RandomSecureInt inverted bounds", testTools.RandomSecureInt, 10, 1},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected a panic for range [%d, %d)", e.low, e.high)
+				}
+			}()
+			e.fn(e.low, e.high)
+		})
+	}
+}
+
+func TestRandomPick(t *testing.T) {
+	items := []string{"hello", "hi", "hey"}
+
+	counts := make(map[string]int)
+	for range 3000 {
+		item, err := RandomPick(items)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		counts[item]++
+	}
+
+	for _, item := range items {
+		if counts[item] < 800 || counts[item] > 1200 {
+			t.Errorf("expected %s to be picked about 1000 times, got %d", item, counts[item])
+		}
+	}
+
+	if len(counts) != len(items) {
+		t.Errorf("expected only items from the slice to be picked, got %v", counts)
+	}
+}
+
+func TestRandomPick_Empty(t *testing.T) {
+	n, err := RandomPick([]int{})
+	if err == nil {
+		t.Error("expected an error for an empty slice, got nil")
+	}
+
+	if n != 0 {
+		t.Errorf("expected the zero value, got %d", n)
+	}
+}
+
 var uploadFileTest = []struct {
 	testName         string
 	expectsError     bool
@@ -168,444 +373,5496 @@ func TestTools_UploadFiles(t *testing.T) {
 	}
 }
 
-func TestTools_UploadOneFile(t *testing.T) {
-	for _, e := range uploadFileTest {
-		t.Run(e.testName, func(t *testing.T) {
-			pr, pw := io.Pipe()
-			writer := multipart.NewWriter(pw)
-			wg := sync.WaitGroup{}
+// testFile describes a file part to be sent by newMultipartRequest
+type testFile struct {
+	name    string
+	content []byte
+}
 
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				defer pw.Close()
-				defer writer.Close()
+// newMultipartRequest builds a multipart POST request with one "file" part for each of files
+func newMultipartRequest(t *testing.T, files ...testFile) *http.Request {
+	t.Helper()
 
-				filePath := filepath.Join(e.dirName, e.fileNames[0])
-				part, err := writer.CreateFormFile("file", filePath)
-				if err != nil {
-					return
-				}
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
 
-				f, err := os.Open(filePath)
-				if err != nil {
-					return
-				}
+	for _, f := range files {
+		part, err := writer.CreateFormFile("file", f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-				_, err = io.Copy(part, f)
-				f.Close()
+		if _, err := part.Write(f.content); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-				if err != nil {
-					return
-				}
-			}()
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
 
-			request := httptest.NewRequest("POST", "/", pr)
-			request.Header.Add("Content-Type", writer.FormDataContentType())
+	request := httptest.NewRequest("POST", "/", body)
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+	return request
+}
 
-			testTools := Tools{
-				AllowedFileTypes: e.allowedFileTypes,
-				MaxFileSize:      int(e.maxFileSize),
-			}
+func TestTools_UploadFiles_MaxIndividualFileSize(t *testing.T) {
+	small := bytes.Repeat([]byte("a"), 100)
+	big := bytes.Repeat([]byte("b"), 2048)
 
-			uploadDir := filepath.Join(e.dirName, "uploads")
-			os.MkdirAll(uploadDir, 0755)
+	request := newMultipartRequest(t,
+		testFile{"first.txt", small},
+		testFile{"oversized.txt", big},
+		testFile{"last.txt", small},
+	)
 
-			uploadedFile, err := testTools.UploadOneFile(request, uploadDir, e.renameFile)
+	testTools := Tools{MaxIndividualFileSize: 1024}
+	uploadDir := t.TempDir()
 
-			if err != nil {
-				if !e.expectsError {
-					t.Errorf("%s: unexpected error: %s", e.testName, err.Error())
-				}
-			} else {
-				if e.expectsError {
-					t.Errorf("%s: expected error but none found", e.testName)
-				}
+	_, err := testTools.UploadFiles(request, uploadDir)
+	if err == nil {
+		t.Fatal("expected an error for the oversized file, got nil")
+	}
 
-				if uploadedFile != nil {
-					if !e.renameFile {
-						if uploadedFile.NewFileName != uploadedFile.OriginalFileName {
-							t.Errorf("%s: file renamed when should not", e.testName)
-						}
-					}
-					path := filepath.Join(uploadDir, uploadedFile.NewFileName)
-					if _, statErr := os.Stat(path); os.IsNotExist(statErr) {
-						t.Errorf("%s: expected file to exist: %s", e.testName, statErr.Error())
-					} else {
-						_ = os.Remove(path)
-					}
-				}
-			}
-			pr.Close()
-			wg.Wait()
-		})
+	if !strings.Contains(err.Error(), "oversized.txt") || !strings.Contains(err.Error(), "2048") {
+		t.Errorf("expected error to name the file and its size, got %q", err.Error())
 	}
 }
 
-func TestTools_CreateDirIfNotExists(t *testing.T) {
-    var testTools Tools
-
-    parentDir := t.TempDir()
-
-    var testDirs = []struct {
-        testName     string
-        expectsError bool
-        dirName      string
-        mode         os.FileMode
-    }{
-        {"creates dir", false, filepath.Join(parentDir, "newDir"), 0755},
-        {"directory already exists", false, filepath.Join(parentDir, "existingDir"), 0755},
-        {"creates subdirectory", false, filepath.Join(parentDir, "sub/level/dir"), 0755},
-        {"invalid path error", true, filepath.Join(parentDir, "invalid\x00path"), 0755},
-    }
-
-    _ = os.Mkdir(filepath.Join(parentDir, "existingDir"), 0755)
-
-    for _, e := range testDirs {
-        t.Run(e.testName, func(t *testing.T) {
-            err := testTools.CreateDirIfNotExists(e.dirName, e.mode)
-            
-            if err != nil && !e.expectsError {
-                t.Errorf("%s: expected no error, but found: %v", e.testName, err)
-            }
-
-            if err == nil && e.expectsError {
-                t.Errorf("%s: expected an error, but got nil", e.testName)
-            }
-        })
-    }
-}
+func TestTools_UploadFiles_MinFileSize(t *testing.T) {
+	testCases := []struct {
+		name         string
+		minFileSize  int
+		content      []byte
+		expectsError bool
+	}{
+		{"empty file rejected", 1, []byte{}, true},
+		{"file below minimum rejected", 10, []byte("short"), true},
+		{"file at minimum accepted", 5, []byte("exact"), false},
+		{"empty file accepted without minimum", 0, []byte{}, false},
+	}
 
-var slugTestTable = []struct {
-	testName       string
-	expectsError   bool
-	errorMsg       string
-	stringToSlugfy string
-	expectedSlug   string
-}{
-	{"simple slug transformation", false, "", "hello World 123", "hello-world-123"},
-	{"all caps string", false, "", "HELLO WORLD ", "hello-world"},
-	{"exclamation sign", false, "", "HELLO WORLD!", "hello-world"},
-	{"empty slug after slugfy string", true, "empty string, after slug process", "!*%.", ""},
-	{"empty string not allowed", true, "empty string not allowed", "", ""},
-}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testTools := Tools{MinFileSize: tc.minFileSize}
+			uploadDir := t.TempDir()
 
-func TestTools_Slugfy(t *testing.T) {
-	var testTools Tools
-	for _, e := range slugTestTable {
-		t.Run(e.testName, func(t *testing.T) {
-			slug, err := testTools.Slugfy(e.stringToSlugfy)
-			if err != nil && !e.expectsError {
-				t.Error("unexpected error for test", e.testName, "error:", err)
+			_, err := testTools.UploadFiles(newMultipartRequest(t, testFile{"small.txt", tc.content}), uploadDir)
+			if err == nil && tc.expectsError {
+				t.Fatal("expected an error but none found")
 			}
 
-			if err == nil && e.expectsError {
-				t.Error("expected error for test", e.testName, "error:", e.errorMsg, "but none found")
+			if err != nil && !tc.expectsError {
+				t.Fatalf("unexpected error: %v", err)
 			}
 
-			if err != nil && e.errorMsg != err.Error() {
-				t.Error("unexpected error message for test", e.testName, "expected error message:", e.errorMsg, "found:", err.Error())
+			if err != nil && !strings.Contains(err.Error(), "small.txt") {
+				t.Errorf("expected error to name the file, got %q", err.Error())
 			}
 
-			if slug != e.expectedSlug {
-				t.Error("unexpected slug for test", e.testName, "expected slug:", e.expectedSlug, "slug received:", slug)
+			if tc.expectsError {
+				entries, _ := os.ReadDir(uploadDir)
+				if len(entries) != 0 {
+					t.Errorf("expected rejected file not to be written, found %d entries", len(entries))
+				}
 			}
 		})
 	}
 }
 
-func TestTools_DownloadStaticFile(t *testing.T) {
-	tmpDir := t.TempDir()
-	fileName := "testfile.txt"
-	content := []byte("conteúdo do arquivo de teste")
-	filePath := filepath.Join(tmpDir, fileName)
-
-	if err := os.WriteFile(filePath, content, 0644); err != nil {
-		t.Fatal(err)
+func TestTools_UploadFiles_MaxFileCount(t *testing.T) {
+	files := []testFile{
+		{"one.txt", []byte("one")},
+		{"two.txt", []byte("two")},
+		{"three.txt", []byte("three")},
 	}
 
-	displayName := "meu-download.txt"
-	tools := New()
+	testTools := Tools{MaxFileCount: 2}
+	uploadDir := t.TempDir()
 
-	req := httptest.NewRequest("GET", "/download", nil)
-	rr := httptest.NewRecorder()
+	_, err := testTools.UploadFiles(newMultipartRequest(t, files...), uploadDir)
+	if err == nil {
+		t.Fatal("expected an error for too many files, got nil")
+	}
 
-	tools.DownloadStaticFile(rr, req, tmpDir, fileName, displayName)
+	if !strings.Contains(err.Error(), "too many files") {
+		t.Errorf("unexpected error message: %s", err.Error())
+	}
 
-	if rr.Code != 200 {
-		t.Errorf("esperava status 200, recebeu %d", rr.Code)
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	expectedHeader := fmt.Sprintf("attachment; filename=\"%s\"", displayName)
-	if got := rr.Header().Get("Content-Disposition"); got != expectedHeader {
-		t.Errorf("cabeçalho Content-Disposition incorreto: esperado %s, recebeu %s", expectedHeader, got)
+	if len(entries) > testTools.MaxFileCount {
+		t.Errorf("expected at most %d files written, found %d", testTools.MaxFileCount, len(entries))
 	}
 
-	if rr.Body.String() != string(content) {
-		t.Errorf("conteúdo do arquivo incorreto: esperado %s, recebeu %s", string(content), rr.Body.String())
+	uploaded, err := testTools.UploadFiles(newMultipartRequest(t, files[:2]...), uploadDir)
+	if err != nil || len(uploaded) != 2 {
+		t.Errorf("expected 2 files within the limit to be uploaded, got %d files and error %v", len(uploaded), err)
 	}
 }
 
-func TestTools_RunServer(t *testing.T) {
-	tools := &Tools{}
+func TestTools_UploadFiles_MaxFileCount_Streaming(t *testing.T) {
+	files := []testFile{
+		{"one.txt", []byte("one")},
+		{"two.txt", []byte("two")},
+		{"three.txt", []byte("three")},
+		{"big.txt", bytes.Repeat([]byte("x"), 8<<20)},
+	}
 
-	t.Run("Graceful Shutdown via Context", func(t *testing.T) {
-		// Use an available port for testing
-		srv := &http.Server{
-			Addr: "localhost:8081",
-			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				w.WriteHeader(http.StatusOK)
-			}),
-		}
+	req := newMultipartRequest(t, files...)
+	total := req.ContentLength
+	body := &countingReader{r: req.Body}
+	req.Body = io.NopCloser(body)
 
-		ctx, cancel := context.WithCancel(context.Background())
+	testTools := Tools{MaxFileCount: 2}
+	_, err := testTools.UploadFiles(req, t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "too many files") {
+		t.Fatalf("expected a too many files error, got %v", err)
+	}
+
+	if read := int64(body.n); read >= total/2 {
+		t.Errorf("expected reading to stop at the third file, read %d of %d bytes", read, total)
+	}
+}
+
+func TestTools_UploadFiles_FilePath(t *testing.T) {
+	var testTools Tools
+	uploadDir := t.TempDir()
+
+	files, err := testTools.UploadFiles(newMultipartRequest(t, testFile{"notes.txt", []byte("some notes")}), uploadDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := filepath.Join(uploadDir, files[0].NewFileName)
+	if files[0].FilePath != expected {
+		t.Errorf("expected FilePath %s, got %s", expected, files[0].FilePath)
+	}
+
+	content, err := os.ReadFile(files[0].FilePath)
+	if err != nil {
+		t.Fatalf("expected FilePath to point to an existing file: %v", err)
+	}
+
+	if string(content) != "some notes" {
+		t.Errorf("unexpected file content: %q", string(content))
+	}
+}
+
+func TestTools_UploadFiles_RenameFunc(t *testing.T) {
+	testTools := Tools{
+		RenameFunc: func(original string) string {
+			ext := filepath.Ext(original)
+			return "20240101-" + strings.TrimSuffix(original, ext) + "-custom" + ext
+		},
+	}
+	uploadDir := t.TempDir()
+
+	files, err := testTools.UploadFiles(newMultipartRequest(t, testFile{"photo.txt", []byte("content")}), uploadDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if files[0].NewFileName != "20240101-photo-custom.txt" {
+		t.Errorf("expected RenameFunc output as new file name, got %s", files[0].NewFileName)
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadDir, "20240101-photo-custom.txt")); err != nil {
+		t.Errorf("expected file to be saved with the custom name: %v", err)
+	}
+
+	files, err = testTools.UploadFiles(newMultipartRequest(t, testFile{"keep.txt", []byte("content")}), uploadDir, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if files[0].NewFileName != "keep.txt" {
+		t.Errorf("RenameFunc should not be used when renaming is off, got %s", files[0].NewFileName)
+	}
+}
+
+func TestTools_UploadFiles_InvalidFileTypeError(t *testing.T) {
+	png, err := os.ReadFile("./test-data/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testTools := Tools{AllowedFileTypes: []string{"image/jpeg"}}
+
+	_, err = testTools.UploadFiles(newMultipartRequest(t, testFile{"photo.png", png}), t.TempDir())
+	if err == nil {
+		t.Fatal("expected an invalid file type error, got nil")
+	}
+
+	if !strings.Contains(err.Error(), "photo.png") || !strings.Contains(err.Error(), "image/png") {
+		t.Errorf("expected error to contain filename and detected type, got %q", err.Error())
+	}
+
+	_, err = testTools.UploadOneFile(newMultipartRequest(t, testFile{"photo.png", png}), t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "photo.png") || !strings.Contains(err.Error(), "image/png") {
+		t.Errorf("expected UploadOneFile error to contain filename and detected type, got %v", err)
+	}
+}
+
+func TestTools_UploadFiles_VerifyExtension(t *testing.T) {
+	png, err := os.ReadFile("./test-data/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name            string
+		fileName        string
+		verifyExtension bool
+		expectsError    bool
+	}{
+		{"matching extension", "image.png", true, false},
+		{"mismatched extension", "image.php", true, true},
+		{"missing extension", "image", true, true},
+		{"flag off", "image.php", false, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testTools := Tools{VerifyExtension: tc.verifyExtension}
+
+			_, err := testTools.UploadFiles(newMultipartRequest(t, testFile{tc.fileName, png}), t.TempDir(), false)
+			if err != nil && !tc.expectsError {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if err == nil && tc.expectsError {
+				t.Error("expected an error but none found")
+			}
+		})
+	}
+}
+
+// cancelAfterReadReader slowly hands out its content and calls cancel once all of it was read
+type cancelAfterReadReader struct {
+	buf    *bytes.Buffer
+	cancel context.CancelFunc
+}
+
+func (c *cancelAfterReadReader) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	n, err := c.buf.Read(p[:min(len(p), 1024)])
+	if c.buf.Len() == 0 {
+		c.cancel()
+	}
+	return n, err
+}
+
+func TestTools_UploadFilesContext_Canceled(t *testing.T) {
+	request := newMultipartRequest(t, testFile{"big.txt", bytes.Repeat([]byte("a"), 64*1024)})
+
+	body := new(bytes.Buffer)
+	if _, err := io.Copy(body, request.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	request.Body = io.NopCloser(&cancelAfterReadReader{buf: body, cancel: cancel})
+
+	var testTools Tools
+	uploadDir := t.TempDir()
+
+	_, err := testTools.UploadFilesContext(ctx, request, uploadDir)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("expected no partial files to remain, found %d", len(entries))
+	}
+}
+
+func TestTools_UploadFiles_WildcardFileTypes(t *testing.T) {
+	png, err := os.ReadFile("./test-data/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdf := []byte("%PDF-1.4 fake pdf content")
+
+	testCases := []struct {
+		name         string
+		allowed      []string
+		file         testFile
+		expectsError bool
+	}{
+		{"image wildcard accepts png", []string{"image/*"}, testFile{"image.png", png}, false},
+		{"upper case image wildcard accepts png", []string{"IMAGE/*"}, testFile{"image.png", png}, false},
+		{"image wildcard rejects pdf", []string{"image/*"}, testFile{"doc.pdf", pdf}, true},
+		{"any type accepts png", []string{"*/*"}, testFile{"image.png", png}, false},
+		{"any type accepts pdf", []string{"*/*"}, testFile{"doc.pdf", pdf}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testTools := Tools{AllowedFileTypes: tc.allowed}
+
+			_, err := testTools.UploadFiles(newMultipartRequest(t, tc.file), t.TempDir())
+			if err != nil && !tc.expectsError {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if err == nil && tc.expectsError {
+				t.Error("expected an error but none found")
+			}
+		})
+	}
+}
+
+func TestTools_IsAllowedFileType(t *testing.T) {
+	testCases := []struct {
+		name        string
+		allowed     []string
+		contentType string
+		expected    bool
+	}{
+		{"empty allowlist", nil, "application/x-msdownload", true},
+		{"exact match", []string{"image/png"}, "image/png", true},
+		{"exact match is case-insensitive", []string{"IMAGE/PNG"}, "image/png", true},
+		{"wildcard match", []string{"image/*"}, "image/jpeg", true},
+		{"wildcard ignores parameters", []string{"text/*"}, "text/plain; charset=utf-8", true},
+		{"rejected", []string{"image/*", "application/pdf"}, "text/html", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testTools := Tools{AllowedFileTypes: tc.allowed}
+
+			if got := testTools.IsAllowedFileType(tc.contentType); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestTools_UploadFiles_Extensions(t *testing.T) {
+	testCases := []struct {
+		name         string
+		allowed      []string
+		blocked      []string
+		fileName     string
+		expectsError bool
+	}{
+		{"blocked extension rejected", nil, []string{".exe"}, "setup.exe", true},
+		{"blocked extension is case-insensitive", nil, []string{"exe"}, "SETUP.EXE", true},
+		{"allowed extension passes", []string{".txt", ".csv"}, nil, "notes.txt", false},
+		{"extension not in allowlist rejected", []string{".txt"}, nil, "notes.md", true},
+		{"blocked takes precedence over allowed", []string{".exe"}, []string{".exe"}, "setup.exe", true},
+		{"no lists allows anything", nil, nil, "anything.bin", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testTools := Tools{AllowedExtensions: tc.allowed, BlockedExtensions: tc.blocked}
+
+			_, err := testTools.UploadFiles(newMultipartRequest(t, testFile{tc.fileName, []byte("plain text")}), t.TempDir())
+			if err != nil && !tc.expectsError {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if err == nil && tc.expectsError {
+				t.Error("expected an error but none found")
+			}
+		})
+	}
+}
+
+func TestTools_UploadFiles_SmallFile(t *testing.T) {
+	testTools := Tools{AllowedFileTypes: []string{"text/plain; charset=utf-8"}}
+	uploadDir := t.TempDir()
+
+	files, err := testTools.UploadFiles(newMultipartRequest(t, testFile{"tiny.txt", []byte("hello")}), uploadDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(files) != 1 || files[0].FileSize != 5 {
+		t.Fatalf("expected one 5-byte file, got %+v", files)
+	}
+
+	content, err := os.ReadFile(filepath.Join(uploadDir, files[0].NewFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(content) != "hello" {
+		t.Errorf("expected stored content to be hello, got %q", string(content))
+	}
+}
+
+func TestTools_UploadFilesWithSummary(t *testing.T) {
+	files := []testFile{
+		{"one.txt", []byte("first file")},
+		{"two.txt", []byte("the second file")},
+		{"three.txt", bytes.Repeat([]byte("c"), 1000)},
+	}
+
+	var testTools Tools
+	summary, err := testTools.UploadFilesWithSummary(newMultipartRequest(t, files...), t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if summary.TotalFiles != len(files) || len(summary.Files) != len(files) {
+		t.Errorf("expected %d files, got %d (%d in slice)", len(files), summary.TotalFiles, len(summary.Files))
+	}
+
+	var expectedBytes, summedBytes int64
+	for _, f := range files {
+		expectedBytes += int64(len(f.content))
+	}
+	for _, f := range summary.Files {
+		summedBytes += f.FileSize
+	}
+
+	if summary.TotalBytes != expectedBytes || summary.TotalBytes != summedBytes {
+		t.Errorf("expected %d total bytes, got %d (sum of files: %d)", expectedBytes, summary.TotalBytes, summedBytes)
+	}
+}
+
+func TestTools_UploadFiles_ComputeChecksum(t *testing.T) {
+	png, err := os.ReadFile("./test-data/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(png)
+	expected := hex.EncodeToString(sum[:])
+
+	testCases := []struct {
+		name             string
+		computeChecksum  bool
+		expectedChecksum string
+	}{
+		{"checksum enabled", true, expected},
+		{"checksum disabled", false, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testTools := Tools{ComputeChecksum: tc.computeChecksum}
+
+			files, err := testTools.UploadFiles(newMultipartRequest(t, testFile{"image.png", png}), t.TempDir())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if files[0].Checksum != tc.expectedChecksum {
+				t.Errorf("expected checksum %q, got %q", tc.expectedChecksum, files[0].Checksum)
+			}
+		})
+	}
+}
+
+func TestTools_UploadFilesWithFields(t *testing.T) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+
+	if err := writer.WriteField("title", "My picture"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteField("tags", "one"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteField("tags", "two"); err != nil {
+		t.Fatal(err)
+	}
+
+	part, err := writer.CreateFormFile("file", "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write([]byte("some notes")); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	request := httptest.NewRequest("POST", "/", body)
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+
+	var testTools Tools
+	files, fields, err := testTools.UploadFilesWithFields(request, t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(files) != 1 || files[0].OriginalFileName != "notes.txt" {
+		t.Errorf("expected notes.txt to be uploaded, got %+v", files)
+	}
+
+	if got := fields["title"]; len(got) != 1 || got[0] != "My picture" {
+		t.Errorf("expected title field, got %v", got)
+	}
+
+	if got := fields["tags"]; len(got) != 2 || got[0] != "one" || got[1] != "two" {
+		t.Errorf("expected both tags values, got %v", got)
+	}
+
+	if got := request.FormValue("title"); got != "My picture" {
+		t.Errorf("expected FormValue access after upload, got %q", got)
+	}
+}
+
+// bufferCloser is an in-memory io.WriteCloser used as upload destination in tests
+type bufferCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestTools_ValidateUpload(t *testing.T) {
+	png, err := os.ReadFile("./test-data/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workDir := t.TempDir()
+	t.Chdir(workDir)
+
+	testTools := Tools{
+		AllowedFileTypes: []string{"image/png", "text/plain; charset=utf-8"},
+		PostUploadFunc: func(f *UploadedFile, path string) error {
+			t.Error("PostUploadFunc should not be called when validating")
+			return nil
+		},
+	}
+
+	files, err := testTools.ValidateUpload(newMultipartRequest(t,
+		testFile{"image.png", png},
+		testFile{"notes.txt", []byte("some notes")},
+	), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]struct {
+		contentType string
+		size        int64
+	}{
+		"image.png": {"image/png", int64(len(png))},
+		"notes.txt": {"text/plain; charset=utf-8", 10},
+	}
+
+	if len(files) != len(expected) {
+		t.Fatalf("expected %d files, got %d", len(expected), len(files))
+	}
+
+	for _, f := range files {
+		e, ok := expected[f.OriginalFileName]
+		if !ok {
+			t.Errorf("unexpected file %s", f.OriginalFileName)
+			continue
+		}
+
+		if f.ContentType != e.contentType {
+			t.Errorf("expected %s to be detected as %s, got %s", f.OriginalFileName, e.contentType, f.ContentType)
+		}
+
+		if f.FileSize != e.size {
+			t.Errorf("expected %s to have %d bytes, got %d", f.OriginalFileName, e.size, f.FileSize)
+		}
+
+		if f.FilePath != "" {
+			t.Errorf("expected no file path when validating, got %s", f.FilePath)
+		}
+	}
+
+	entries, err := os.ReadDir(workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("expected no files to be written, found %d entries", len(entries))
+	}
+
+	_, err = testTools.ValidateUpload(newMultipartRequest(t, testFile{"script.sh", []byte("\x00\x01binary")}))
+	if err == nil || !strings.Contains(err.Error(), "invalid file type") {
+		t.Errorf("expected an invalid file type error, got %v", err)
+	}
+}
+
+func TestTools_UploadFiles_MaxFilenameLength(t *testing.T) {
+	longName := strings.Repeat("a", 296) + ".txt"
+
+	testCases := []struct {
+		name      string
+		maxLength int
+		fileName  string
+		expected  string
+	}{
+		{"long name truncated keeping extension", 255, longName, strings.Repeat("a", 251) + ".txt"},
+		{"short name kept", 255, "notes.txt", "notes.txt"},
+		{"multi-byte name cut at rune boundary", 8, "ééééé.txt", "éé.txt"},
+		{"extension longer than limit", 4, "a.verylongext", "a.ve"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testTools := Tools{MaxFilenameLength: tc.maxLength}
+			dir := t.TempDir()
+
+			files, err := testTools.UploadFiles(newMultipartRequest(t, testFile{tc.fileName, []byte("plain text")}), dir, false)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if files[0].NewFileName != tc.expected {
+				t.Errorf("expected file name %q, got %q", tc.expected, files[0].NewFileName)
+			}
+
+			if _, err := os.Stat(filepath.Join(dir, tc.expected)); err != nil {
+				t.Errorf("expected the file to be saved as %q: %v", tc.expected, err)
+			}
+		})
+	}
+
+	t.Run("renamed conflict stays within the limit", func(t *testing.T) {
+		testTools := Tools{MaxFilenameLength: 255, OnConflict: ConflictRename}
+		dir := t.TempDir()
+		atLimit := strings.Repeat("a", 251) + ".txt"
+
+		for _, expected := range []string{atLimit, strings.Repeat("a", 249) + "-2.txt", strings.Repeat("a", 249) + "-3.txt"} {
+			files, err := testTools.UploadFiles(newMultipartRequest(t, testFile{atLimit, []byte("plain text")}), dir, false)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if files[0].NewFileName != expected {
+				t.Errorf("expected file name %q, got %q", expected, files[0].NewFileName)
+			}
+		}
+	})
+
+	t.Run("no limit", func(t *testing.T) {
+		var testTools Tools
+
+		_, err := testTools.UploadFiles(newMultipartRequest(t, testFile{longName, []byte("plain text")}), t.TempDir(), false)
+		if !errors.Is(err, syscall.ENAMETOOLONG) {
+			t.Errorf("expected a file name too long error, got %v", err)
+		}
+	})
+}
+
+func TestTools_SanitizeFilename(t *testing.T) {
+	var testTools Tools
+
+	var tests = []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"path traversal", "../../evil.sh", "evil.sh"},
+		{"windows path", `..\..\windows\evil.bat`, "evil.bat"},
+		{"spaces", "my holiday  photo.jpg", "my_holiday_photo.jpg"},
+		{"hidden dotfile", ".htaccess", "htaccess"},
+		{"several leading dots", "...profile.txt", "profile.txt"},
+		{"null byte and control characters", "report\x00\n.pdf", "report_.pdf"},
+		{"dangerous characters", `a<b>c:d"e|f?g*h.txt`, "a_b_c_d_e_f_g_h.txt"},
+		{"unicode letters are kept", "relatório-final.docx", "relatório-final.docx"},
+		{"already safe", "image_01.png", "image_01.png"},
+		{"underscores are kept", "__init__.py", "__init__.py"},
+		{"trailing underscore is kept", "draft_.txt_", "draft_.txt_"},
+		{"replaced characters at the edges", " <notes>.txt ", "notes_.txt"},
+		{"dotfile after spaces", "  .bashrc", "bashrc"},
+		{"nothing left", "../..", "file"},
+		{"empty", "", "file"},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			if got := testTools.SanitizeFilename(e.input); got != e.expected {
+				t.Errorf("expected %q, got %q", e.expected, got)
+			}
+		})
+	}
+}
+
+func TestTools_UploadFiles_SanitizesKeptNames(t *testing.T) {
+	var testTools Tools
+	uploadDir := t.TempDir()
+
+	files, err := testTools.UploadFiles(newMultipartRequest(t, testFile{"my notes.txt", []byte("content")}), uploadDir, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if files[0].NewFileName != "my_notes.txt" || files[0].OriginalFileName != "my notes.txt" {
+		t.Errorf("expected my notes.txt to be saved as my_notes.txt, got %+v", files[0])
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadDir, "my_notes.txt")); err != nil {
+		t.Errorf("expected sanitized file to be saved: %v", err)
+	}
+}
+
+// newZip returns a zip archive holding an empty file for each of names
+func newZip(t *testing.T, names ...string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		if _, err := zw.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+const docxContentType = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+
+func TestTools_DetectContentType(t *testing.T) {
+	var testTools Tools
+
+	var tests = []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{"docx", newZip(t, "[Content_Types].xml", "_rels/.rels", "word/document.xml"), docxContentType},
+		{"xlsx", newZip(t, "[Content_Types].xml", "xl/workbook.xml"), "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{"pptx", newZip(t, "[Content_Types].xml", "ppt/presentation.xml"), "application/vnd.openxmlformats-officedocument.presentationml.presentation"},
+		{"plain zip", newZip(t, "readme.txt", "src/main.go"), "application/zip"},
+		{"text", []byte("just some text"), "text/plain; charset=utf-8"},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			contentType, err := testTools.DetectContentType(bytes.NewReader(e.data))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if contentType != e.expected {
+				t.Errorf("expected %s, got %s", e.expected, contentType)
+			}
+		})
+	}
+}
+
+func TestTools_FileContentType(t *testing.T) {
+	var testTools Tools
+
+	binary := []byte{0x00, 0x01, 0x02, 0x03, 0xfe, 0xff}
+
+	var tests = []struct {
+		name     string
+		path     string
+		data     []byte
+		expected string
+	}{
+		{"text", "notes.txt", []byte("just some text"), "text/plain; charset=utf-8"},
+		{"png", "image.png", nil, "image/png"},
+		{"extensionless binary", "blob", binary, "application/octet-stream"},
+		{"binary falls back to extension", "image.webp", binary, "image/webp"},
+		{"empty file", "empty.bin", []byte{}, "text/plain; charset=utf-8"},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			path := "./test-data/image.png"
+			if e.data != nil {
+				path = filepath.Join(t.TempDir(), e.path)
+				if err := os.WriteFile(path, e.data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			contentType, err := testTools.FileContentType(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if contentType != e.expected {
+				t.Errorf("expected %s, got %s", e.expected, contentType)
+			}
+		})
+	}
+
+	if _, err := testTools.FileContentType(filepath.Join(t.TempDir(), "missing.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a not exist error, got %v", err)
+	}
+}
+
+func TestTools_UploadFiles_OfficeFileTypes(t *testing.T) {
+	testTools := Tools{AllowedFileTypes: []string{docxContentType}}
+
+	files, err := testTools.UploadFiles(newMultipartRequest(t, testFile{"report.docx", newZip(t, "word/document.xml")}), t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if files[0].ContentType != docxContentType {
+		t.Errorf("expected docx content type, got %s", files[0].ContentType)
+	}
+
+	_, err = testTools.UploadFiles(newMultipartRequest(t, testFile{"report.docx", newZip(t, "readme.txt")}), t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "invalid file type application/zip") {
+		t.Errorf("expected a plain zip to be rejected, got %v", err)
+	}
+}
+
+func TestTools_BuildMultipartRequest(t *testing.T) {
+	var testTools Tools
+
+	files := map[string][]byte{
+		"a.txt": []byte("first file"),
+		"b.csv": []byte("id,name\n1,foo\n"),
+	}
+	fields := map[string]string{"title": "My files", "owner": "jack"}
+
+	request, err := testTools.BuildMultipartRequest("upload", files, fields)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if request.Method != http.MethodPost {
+		t.Errorf("expected POST, got %s", request.Method)
+	}
+
+	if err := request.ParseMultipartForm(1024 * 1024); err != nil {
+		t.Fatalf("failed to parse built request: %v", err)
+	}
+
+	for name, value := range fields {
+		if got := request.FormValue(name); got != value {
+			t.Errorf("expected field %s to be %q, got %q", name, value, got)
+		}
+	}
+
+	headers := request.MultipartForm.File["upload"]
+	if len(headers) != len(files) {
+		t.Fatalf("expected %d files, got %d", len(files), len(headers))
+	}
+
+	for _, hdr := range headers {
+		f, err := hdr.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(content, files[hdr.Filename]) {
+			t.Errorf("expected content of %s to be %q, got %q", hdr.Filename, files[hdr.Filename], content)
+		}
+	}
+}
+
+func TestTools_UploadFiles_MaxDecompressedSize(t *testing.T) {
+	newZipWith := func(t *testing.T, content []byte) []byte {
+		t.Helper()
+
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		w, err := zw.Create("data.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	png, err := os.ReadFile("./test-data/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		content  []byte
+		limit    int64
+		errorMsg string
+	}{
+		{"normal zip", png, 10 * 1024 * 1024, ""},
+		{"high compression ratio", make([]byte, 10*1024*1024), 100 * 1024 * 1024, "suspicious compression ratio"},
+		{"declared size over the limit", png, 1024, "is too big when decompressed"},
+		{"no limit", make([]byte, 10*1024*1024), 0, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testTools := Tools{MaxDecompressedSize: tc.limit}
+
+			_, err := testTools.UploadFiles(newMultipartRequest(t, testFile{"archive.zip", newZipWith(t, tc.content)}), t.TempDir())
+
+			if tc.errorMsg == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.errorMsg) {
+				t.Errorf("expected error containing %q, got %v", tc.errorMsg, err)
+			}
+		})
+	}
+}
+
+func TestTools_UploadFilesToMemory(t *testing.T) {
+	png, err := os.ReadFile("./test-data/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("returns the uploaded content", func(t *testing.T) {
+		testTools := Tools{AllowedFileTypes: []string{"image/png", "text/plain; charset=utf-8"}}
+
+		files, err := testTools.UploadFilesToMemory(newMultipartRequest(t,
+			testFile{"config.txt", []byte("debug = true")},
+			testFile{"image.png", png},
+		))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(files) != 2 {
+			t.Fatalf("expected 2 files, got %d", len(files))
+		}
+
+		expected := []InMemoryFile{
+			{"config.txt", "text/plain; charset=utf-8", []byte("debug = true")},
+			{"image.png", "image/png", png},
+		}
+		for i, e := range expected {
+			f := files[i]
+			if f.Filename != e.Filename || f.ContentType != e.ContentType {
+				t.Errorf("expected %s with type %s, got %s with type %s", e.Filename, e.ContentType, f.Filename, f.ContentType)
+			}
+
+			if !bytes.Equal(f.Content, e.Content) {
+				t.Errorf("expected the content of %s to match the upload", e.Filename)
+			}
+		}
+	})
+
+	t.Run("keeps parts with the same name apart", func(t *testing.T) {
+		var backups, hooks int
+		testTools := Tools{
+			RenameFunc:        func(string) string { return "same.txt" },
+			MaxFilenameLength: 1,
+			UploadConcurrency: 2,
+			BackupWriter: func(string) (io.WriteCloser, error) {
+				backups++
+				return &bufferCloser{}, nil
+			},
+			PostUploadFunc: func(*UploadedFile, string) error {
+				hooks++
+				return nil
+			},
+		}
+
+		files, err := testTools.UploadFilesToMemory(newMultipartRequest(t,
+			testFile{"config.txt", []byte("first")},
+			testFile{"config.txt", []byte("second")},
+		))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(files) != 2 || string(files[0].Content) != "first" || string(files[1].Content) != "second" {
+			t.Errorf("expected the content of both parts, got %+v", files)
+		}
+
+		if backups != 0 || hooks != 0 {
+			t.Errorf("expected BackupWriter and PostUploadFunc not to be called, got %d and %d calls", backups, hooks)
+		}
+	})
+
+	t.Run("rejects oversized files", func(t *testing.T) {
+		testTools := Tools{MaxFileSize: 1024}
+
+		files, err := testTools.UploadFilesToMemory(newMultipartRequest(t, testFile{"image.png", png}))
+		if err == nil {
+			t.Error("expected an error for an oversized file, got nil")
+		}
+
+		if files != nil {
+			t.Errorf("expected no files, got %d", len(files))
+		}
+	})
+
+	t.Run("rejects disallowed types", func(t *testing.T) {
+		testTools := Tools{AllowedFileTypes: []string{"image/png"}}
+
+		_, err := testTools.UploadFilesToMemory(newMultipartRequest(t, testFile{"config.txt", []byte("debug = true")}))
+		if err == nil || !strings.Contains(err.Error(), "invalid file type") {
+			t.Errorf("expected an invalid file type error, got %v", err)
+		}
+	})
+}
+
+func TestTools_UploadFilesToWriter(t *testing.T) {
+	png, err := os.ReadFile("./test-data/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(map[string]*bufferCloser)
+	newWriter := func(filename string) (io.WriteCloser, error) {
+		b := new(bufferCloser)
+		written[filename] = b
+		return b, nil
+	}
+
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}}
+	files, err := testTools.UploadFilesToWriter(newMultipartRequest(t, testFile{"image.png", png}), newWriter, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(files))
+	}
+
+	b, ok := written["image.png"]
+	if !ok {
+		t.Fatal("writer factory was not called with the file name")
+	}
+
+	if !b.closed {
+		t.Error("expected writer to be closed")
+	}
+
+	if !bytes.Equal(b.Bytes(), png) {
+		t.Error("written bytes do not match the uploaded content")
+	}
+
+	if files[0].FileSize != int64(len(png)) {
+		t.Errorf("expected file size %d, got %d", len(png), files[0].FileSize)
+	}
+}
+
+func TestTools_UploadFiles_ProgressFunc(t *testing.T) {
+	content := bytes.Repeat([]byte("progress "), 20000)
+
+	var calls [][2]int64
+	testTools := Tools{ProgressFunc: func(filename string, bytesWritten, totalBytes int64) {
+		if filename != "big.txt" {
+			t.Errorf("expected file name big.txt, got %s", filename)
+		}
+		calls = append(calls, [2]int64{bytesWritten, totalBytes})
+	}}
+
+	_, err := testTools.UploadFiles(newMultipartRequest(t, testFile{"big.txt", content}), t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(calls) < 2 {
+		t.Fatalf("expected the callback to be called several times, got %d calls", len(calls))
+	}
+
+	for i, c := range calls {
+		if i > 0 && c[0] <= calls[i-1][0] {
+			t.Errorf("expected increasing byte counts, got %d after %d", c[0], calls[i-1][0])
+		}
+
+		if c[1] != int64(len(content)) {
+			t.Errorf("expected total of %d bytes, got %d", len(content), c[1])
+		}
+	}
+
+	if last := calls[len(calls)-1][0]; last != int64(len(content)) {
+		t.Errorf("expected the last call to report %d bytes, got %d", len(content), last)
+	}
+}
+
+func TestTools_UploadFiles_Concurrency(t *testing.T) {
+	var files []testFile
+	for i := range 50 {
+		files = append(files, testFile{fmt.Sprintf("file-%02d.txt", i), []byte(fmt.Sprintf("content of file %d", i))})
+	}
+
+	testTools := Tools{UploadConcurrency: 4}
+	dir := t.TempDir()
+
+	uploaded, err := testTools.UploadFiles(newMultipartRequest(t, files...), dir, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(uploaded) != len(files) {
+		t.Fatalf("expected %d files, got %d", len(files), len(uploaded))
+	}
+
+	for i, f := range uploaded {
+		if f.OriginalFileName != files[i].name {
+			t.Errorf("expected file %d to be %s, got %s", i, files[i].name, f.OriginalFileName)
+		}
+
+		content, err := os.ReadFile(filepath.Join(dir, f.NewFileName))
+		if err != nil {
+			t.Errorf("expected %s on disk: %v", f.NewFileName, err)
+			continue
+		}
+
+		if !bytes.Equal(content, files[i].content) {
+			t.Errorf("expected %s to contain %q, got %q", f.NewFileName, files[i].content, content)
+		}
+	}
+}
+
+func TestTools_UploadFiles_Concurrency_Conflicts(t *testing.T) {
+	var files []testFile
+	for i := range 20 {
+		files = append(files, testFile{"same.txt", []byte(fmt.Sprintf("content of file %d", i))})
+	}
+
+	t.Run("rename", func(t *testing.T) {
+		testTools := Tools{UploadConcurrency: 8, OnConflict: ConflictRename}
+		dir := t.TempDir()
+
+		uploaded, err := testTools.UploadFiles(newMultipartRequest(t, files...), dir, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		names := make(map[string]bool)
+		for i, f := range uploaded {
+			if names[f.NewFileName] {
+				t.Errorf("file name %s used twice", f.NewFileName)
+			}
+			names[f.NewFileName] = true
+
+			content, err := os.ReadFile(filepath.Join(dir, f.NewFileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, files[i].content) {
+				t.Errorf("expected %s to contain %q, got %q", f.NewFileName, files[i].content, content)
+			}
+		}
+
+		if len(names) != len(files) {
+			t.Errorf("expected %d distinct files, got %d", len(files), len(names))
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		testTools := Tools{UploadConcurrency: 8, OnConflict: ConflictError}
+		dir := t.TempDir()
+
+		uploaded, err := testTools.UploadFiles(newMultipartRequest(t, files...), dir, false)
+		if !errors.Is(err, ErrFileExists) {
+			t.Errorf("expected ErrFileExists, got %v", err)
+		}
+
+		if len(uploaded) != 1 {
+			t.Fatalf("expected a single file to be uploaded, got %d", len(uploaded))
+		}
+
+		content, err := os.ReadFile(filepath.Join(dir, "same.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.ContainsFunc(files, func(f testFile) bool { return bytes.Equal(f.content, content) }) {
+			t.Errorf("expected same.txt to hold one of the uploads, got %q", content)
+		}
+	})
+}
+
+func TestTools_UploadFiles_Concurrency_Error(t *testing.T) {
+	files := []testFile{
+		{"a.txt", []byte("plain text")},
+		{"b.txt", []byte("plain text")},
+		{"c.exe", []byte("plain text")},
+		{"d.txt", []byte("plain text")},
+	}
+
+	testCases := []struct {
+		name          string
+		atomic        bool
+		expectedFiles int
+	}{
+		{"keeps the files uploaded", false, 2},
+		{"atomic upload removes the files uploaded", true, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testTools := Tools{UploadConcurrency: 2, BlockedExtensions: []string{".exe"}, AtomicUpload: tc.atomic}
+			dir := t.TempDir()
+
+			_, err := testTools.UploadFiles(newMultipartRequest(t, files...), dir, false)
+			if err == nil || !strings.Contains(err.Error(), "c.exe") {
+				t.Errorf("expected the error of c.exe, got %v", err)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// d.txt may or may not have been started before c.exe failed
+			if len(entries) < tc.expectedFiles || (tc.atomic && len(entries) != 0) {
+				t.Errorf("expected %d files on disk, got %d", tc.expectedFiles, len(entries))
+			}
+		})
+	}
+}
+
+func TestTools_UploadFiles_AtomicUpload(t *testing.T) {
+	png, err := os.ReadFile("./test-data/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := newMultipartRequest(t,
+		testFile{"first.png", png},
+		testFile{"second.png", png},
+		testFile{"last.txt", []byte("not an image")},
+	)
+
+	testTools := Tools{
+		AllowedFileTypes: []string{"image/png"},
+		AtomicUpload:     true,
+	}
+	uploadDir := t.TempDir()
+
+	files, err := testTools.UploadFiles(request, uploadDir)
+	if err == nil {
+		t.Fatal("expected an error for the last file, got nil")
+	}
+
+	if len(files) != 0 {
+		t.Errorf("expected no uploaded files to be returned, got %d", len(files))
+	}
+
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("expected upload dir to be empty, found %d entries", len(entries))
+	}
+}
+
+func TestTools_UploadFiles_MultipartMemory(t *testing.T) {
+	png, err := os.ReadFile("./test-data/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// upload dirs are created up front, since t.TempDir would create them in TMPDIR once it is changed
+	uploadRoot := t.TempDir()
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+
+	testCases := []struct {
+		name            string
+		multipartMemory int64
+		expectsSpill    bool
+	}{
+		{"small memory spills to disk", 1024, true},
+		{"default memory keeps the file in memory", 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			spilled := false
+			testTools := Tools{
+				MultipartMemory: tc.multipartMemory,
+				PostUploadFunc: func(f *UploadedFile, path string) error {
+					entries, err := os.ReadDir(tempDir)
+					if err != nil {
+						return err
+					}
+					spilled = len(entries) > 0
+					return nil
+				},
+			}
+			uploadDir := filepath.Join(uploadRoot, strconv.FormatInt(tc.multipartMemory, 10))
+			request := newMultipartRequest(t, testFile{"image.png", png})
+
+			files, err := testTools.UploadFiles(request, uploadDir, false)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if spilled != tc.expectsSpill {
+				t.Errorf("expected the upload to spill to a temporary file: %v, got %v", tc.expectsSpill, spilled)
+			}
+
+			saved, err := os.ReadFile(files[0].FilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(saved, png) {
+				t.Errorf("expected saved file to match the uploaded one, got %d bytes", len(saved))
+			}
+		})
+	}
+}
+
+func TestTools_UploadFiles_RemovesTempFiles(t *testing.T) {
+	png, err := os.ReadFile("./test-data/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+
+	countTempFiles := func() int {
+		entries, err := os.ReadDir(tempDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	buffered := 0
+	testTools := Tools{
+		MultipartMemory: 1024,
+		PostUploadFunc: func(f *UploadedFile, path string) error {
+			buffered = countTempFiles()
+			return nil
+		},
+	}
+
+	for range 3 {
+		request := newMultipartRequest(t, testFile{"image.png", png})
+		if _, err := testTools.UploadFiles(request, t.TempDir()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if buffered == 0 {
+		t.Fatal("expected the upload to be buffered in a temporary file")
+	}
+
+	if n := countTempFiles(); n != 0 {
+		t.Errorf("expected temporary files to be removed, found %d", n)
+	}
+}
+
+func TestTools_UploadFiles_DecompressGzipUploads(t *testing.T) {
+	content := strings.Repeat("some compressible text\n", 200)
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+
+	testCases := []struct {
+		name         string
+		fileName     string
+		expectedName string
+	}{
+		{"gz extension", "notes.txt.gz", "notes.txt"},
+		{"gzip magic bytes", "notes.txt", "notes.txt"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testTools := Tools{
+				DecompressGzipUploads: true,
+				AllowedFileTypes:      []string{"text/*"},
+			}
+			uploadDir := t.TempDir()
+
+			files, err := testTools.UploadFiles(newMultipartRequest(t, testFile{tc.fileName, compressed.Bytes()}), uploadDir, false)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if files[0].NewFileName != tc.expectedName {
+				t.Errorf("expected file to be saved as %s, got %s", tc.expectedName, files[0].NewFileName)
+			}
+
+			if files[0].FileSize != int64(len(content)) {
+				t.Errorf("expected decompressed size %d, got %d", len(content), files[0].FileSize)
+			}
+
+			saved, err := os.ReadFile(filepath.Join(uploadDir, tc.expectedName))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(saved) != content {
+				t.Error("expected the stored file to be decompressed")
+			}
+		})
+	}
+
+	t.Run("invalid gzip data", func(t *testing.T) {
+		testTools := Tools{DecompressGzipUploads: true}
+
+		_, err := testTools.UploadFiles(newMultipartRequest(t, testFile{"notes.txt.gz", []byte("not gzip")}), t.TempDir())
+		if err == nil || !strings.Contains(err.Error(), "not valid gzip data") {
+			t.Errorf("expected an invalid gzip error, got %v", err)
+		}
+	})
+
+	t.Run("gzip bomb", func(t *testing.T) {
+		var bomb bytes.Buffer
+		gz := gzip.NewWriter(&bomb)
+		if _, err := gz.Write(make([]byte, 10*1024*1024)); err != nil {
+			t.Fatal(err)
+		}
+		gz.Close()
+
+		testCases := []struct {
+			name  string
+			tools Tools
+			limit int
+		}{
+			{"MaxDecompressedSize", Tools{DecompressGzipUploads: true, MaxDecompressedSize: 1024 * 1024}, 1024 * 1024},
+			{"falls back to MaxIndividualFileSize", Tools{DecompressGzipUploads: true, MaxIndividualFileSize: 512 * 1024}, 512 * 1024},
+			{"falls back to MaxFileSize", Tools{DecompressGzipUploads: true, MaxFileSize: 256 * 1024}, 256 * 1024},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				uploadDir := t.TempDir()
+
+				_, err := tc.tools.UploadFiles(newMultipartRequest(t, testFile{"zeros.bin.gz", bomb.Bytes()}), uploadDir, false)
+				expected := fmt.Sprintf("is too big when decompressed: it exceeds the limit of %d bytes", tc.limit)
+				if err == nil || !strings.Contains(err.Error(), expected) {
+					t.Errorf("expected error containing %q, got %v", expected, err)
+				}
+
+				entries, err := os.ReadDir(uploadDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(entries) != 0 {
+					t.Errorf("expected the partial file to be removed, found %d files", len(entries))
+				}
+			})
+		}
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		var testTools Tools
+		uploadDir := t.TempDir()
+
+		files, err := testTools.UploadFiles(newMultipartRequest(t, testFile{"notes.txt.gz", compressed.Bytes()}), uploadDir, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if files[0].NewFileName != "notes.txt.gz" || files[0].FileSize != int64(compressed.Len()) {
+			t.Errorf("expected the compressed file to be stored as is, got %+v", files[0])
+		}
+	})
+}
+
+func TestTools_UploadFiles_BackupWriter(t *testing.T) {
+	png, err := os.ReadFile("./test-data/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backups := make(map[string]*bufferCloser)
+	testTools := Tools{
+		BackupWriter: func(filename string) (io.WriteCloser, error) {
+			b := &bufferCloser{}
+			backups[filename] = b
+			return b, nil
+		},
+	}
+	uploadDir := t.TempDir()
+
+	files, err := testTools.UploadFiles(newMultipartRequest(t,
+		testFile{"image.png", png},
+		testFile{"notes.txt", []byte("some notes")},
+	), uploadDir, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, f := range files {
+		saved, err := os.ReadFile(f.FilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		backup, ok := backups[f.NewFileName]
+		if !ok {
+			t.Fatalf("expected a backup of %s", f.NewFileName)
+		}
+
+		if !backup.closed {
+			t.Errorf("expected backup of %s to be closed", f.NewFileName)
+		}
+
+		if !bytes.Equal(saved, backup.Bytes()) {
+			t.Errorf("expected backup of %s to match the stored file", f.NewFileName)
+		}
+	}
+
+	t.Run("backup error", func(t *testing.T) {
+		testTools := Tools{
+			BackupWriter: func(filename string) (io.WriteCloser, error) {
+				return nil, errors.New("backup unavailable")
+			},
+		}
+		uploadDir := t.TempDir()
+
+		_, err := testTools.UploadFiles(newMultipartRequest(t, testFile{"notes.txt", []byte("some notes")}), uploadDir)
+		if err == nil || err.Error() != "backup unavailable" {
+			t.Errorf("expected the backup error, got %v", err)
+		}
+
+		entries, err := os.ReadDir(uploadDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(entries) != 0 {
+			t.Errorf("expected the local file to be removed, found %d entries", len(entries))
+		}
+	})
+}
+
+func TestTools_UploadFiles_OnConflict_ConcurrentRequests(t *testing.T) {
+	testCases := []struct {
+		name         string
+		policy       ConflictPolicy
+		expectedErr  error
+		expectedName string
+	}{
+		{"error", ConflictError, ErrFileExists, ""},
+		{"rename", ConflictRename, nil, "same-2.txt"},
+		{"skip", ConflictSkip, nil, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testTools := Tools{OnConflict: tc.policy}
+			dir := t.TempDir()
+			filePath := func(name string) string { return filepath.Join(dir, name) }
+
+			// another request creates same.txt after the conflict check found it free
+			createInDir := testTools.createInDir(dir)
+			raced := false
+			create := func(name string) (io.WriteCloser, error) {
+				if !raced {
+					raced = true
+					if err := os.WriteFile(filePath(name), []byte("other request"), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return createInDir(name)
+			}
+
+			req := newMultipartRequest(t, testFile{"same.txt", []byte("this request")})
+			files, err := testTools.uploadFiles(context.Background(), req, false, create, nil, filePath)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error %v, got %v", tc.expectedErr, err)
+			}
+
+			content, err := os.ReadFile(filePath("same.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != "other request" {
+				t.Errorf("expected the file of the other request to be kept, got %q", content)
+			}
+
+			if tc.expectedName == "" {
+				if len(files) != 0 {
+					t.Errorf("expected no file to be saved, got %v", files)
+				}
+				return
+			}
+
+			if len(files) != 1 || files[0].NewFileName != tc.expectedName {
+				t.Fatalf("expected the file to be saved as %s, got %v", tc.expectedName, files)
+			}
+		})
+	}
+}
+
+func TestTools_UploadFiles_OnConflict(t *testing.T) {
+	testCases := []struct {
+		name            string
+		policy          ConflictPolicy
+		expectedFiles   []string
+		expectedContent map[string]string
+		expectsError    bool
+	}{
+		{"overwrite", ConflictOverwrite, []string{"notes.txt"}, map[string]string{"notes.txt": "new"}, false},
+		{"skip", ConflictSkip, nil, map[string]string{"notes.txt": "old"}, false},
+		{"error", ConflictError, nil, map[string]string{"notes.txt": "old"}, true},
+		{"rename", ConflictRename, []string{"notes-3.txt"}, map[string]string{"notes.txt": "old", "notes-2.txt": "older", "notes-3.txt": "new"}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uploadDir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(uploadDir, "notes.txt"), []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tc.policy == ConflictRename {
+				if err := os.WriteFile(filepath.Join(uploadDir, "notes-2.txt"), []byte("older"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			testTools := Tools{OnConflict: tc.policy}
+			files, err := testTools.UploadFiles(newMultipartRequest(t, testFile{"notes.txt", []byte("new")}), uploadDir, false)
+
+			if tc.expectsError {
+				if !errors.Is(err, ErrFileExists) {
+					t.Errorf("expected ErrFileExists, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var names []string
+			for _, f := range files {
+				names = append(names, f.NewFileName)
+			}
+
+			if !slices.Equal(names, tc.expectedFiles) {
+				t.Errorf("expected uploaded files %v, got %v", tc.expectedFiles, names)
+			}
+
+			for name, content := range tc.expectedContent {
+				saved, err := os.ReadFile(filepath.Join(uploadDir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if string(saved) != content {
+					t.Errorf("expected %s to contain %q, got %q", name, content, saved)
+				}
+			}
+		})
+	}
+}
+
+func TestTools_UploadFiles_PostUploadFunc(t *testing.T) {
+	uploadDir := t.TempDir()
+
+	var calls []string
+	testTools := Tools{
+		PostUploadFunc: func(f *UploadedFile, path string) error {
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("expected %s to exist when the hook runs: %v", path, err)
+			}
+			if path != f.FilePath {
+				t.Errorf("expected path %s to match FilePath %s", path, f.FilePath)
+			}
+			calls = append(calls, path)
+			return nil
+		},
+	}
+
+	files, err := testTools.UploadFiles(newMultipartRequest(t,
+		testFile{"one.txt", []byte("first")},
+		testFile{"two.txt", []byte("second")},
+	), uploadDir, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(calls) != len(files) {
+		t.Fatalf("expected hook to be called %d times, got %d", len(files), len(calls))
+	}
+
+	for _, name := range []string{"one.txt", "two.txt"} {
+		if !slices.Contains(calls, filepath.Join(uploadDir, name)) {
+			t.Errorf("expected hook to be called for %s, got %v", name, calls)
+		}
+	}
+}
+
+func TestTools_UploadFiles_PostUploadFuncError(t *testing.T) {
+	uploadDir := t.TempDir()
+
+	hookErr := errors.New("thumbnail failed")
+	calls := 0
+	testTools := Tools{
+		AtomicUpload: true,
+		PostUploadFunc: func(f *UploadedFile, path string) error {
+			calls++
+			if calls == 2 {
+				return hookErr
+			}
+			return nil
+		},
+	}
+
+	files, err := testTools.UploadFiles(newMultipartRequest(t,
+		testFile{"one.txt", []byte("first")},
+		testFile{"two.txt", []byte("second")},
+	), uploadDir)
+	if !errors.Is(err, hookErr) {
+		t.Fatalf("expected hook error, got %v", err)
+	}
+
+	if len(files) != 0 {
+		t.Errorf("expected no uploaded files to be returned, got %d", len(files))
+	}
+
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("expected upload dir to be empty, found %d entries", len(entries))
+	}
+}
+
+func TestTools_UploadFiles_PostUploadFuncError_NotAtomic(t *testing.T) {
+	uploadDir := t.TempDir()
+
+	hookErr := errors.New("thumbnail failed")
+	testTools := Tools{
+		PostUploadFunc: func(f *UploadedFile, path string) error {
+			if f.OriginalFileName == "two.txt" {
+				return hookErr
+			}
+			return nil
+		},
+	}
+
+	files, err := testTools.UploadFiles(newMultipartRequest(t,
+		testFile{"one.txt", []byte("first")},
+		testFile{"two.txt", []byte("second")},
+	), uploadDir, false)
+	if !errors.Is(err, hookErr) {
+		t.Fatalf("expected hook error, got %v", err)
+	}
+
+	if len(files) != 1 || files[0].NewFileName != "one.txt" {
+		t.Errorf("expected one.txt to be returned, got %v", files)
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadDir, "one.txt")); err != nil {
+		t.Errorf("expected one.txt to be kept: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadDir, "two.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the rejected two.txt to be removed, got %v", err)
+	}
+}
+
+func TestTools_UploadOneFile(t *testing.T) {
+	for _, e := range uploadFileTest {
+		t.Run(e.testName, func(t *testing.T) {
+			pr, pw := io.Pipe()
+			writer := multipart.NewWriter(pw)
+			wg := sync.WaitGroup{}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer pw.Close()
+				defer writer.Close()
+
+				filePath := filepath.Join(e.dirName, e.fileNames[0])
+				part, err := writer.CreateFormFile("file", filePath)
+				if err != nil {
+					return
+				}
+
+				f, err := os.Open(filePath)
+				if err != nil {
+					return
+				}
+
+				_, err = io.Copy(part, f)
+				f.Close()
+
+				if err != nil {
+					return
+				}
+			}()
+
+			request := httptest.NewRequest("POST", "/", pr)
+			request.Header.Add("Content-Type", writer.FormDataContentType())
+
+			testTools := Tools{
+				AllowedFileTypes: e.allowedFileTypes,
+				MaxFileSize:      int(e.maxFileSize),
+			}
+
+			uploadDir := filepath.Join(e.dirName, "uploads")
+			os.MkdirAll(uploadDir, 0755)
+
+			uploadedFile, err := testTools.UploadOneFile(request, uploadDir, e.renameFile)
+
+			if err != nil {
+				if !e.expectsError {
+					t.Errorf("%s: unexpected error: %s", e.testName, err.Error())
+				}
+			} else {
+				if e.expectsError {
+					t.Errorf("%s: expected error but none found", e.testName)
+				}
+
+				if uploadedFile != nil {
+					if !e.renameFile {
+						if uploadedFile.NewFileName != uploadedFile.OriginalFileName {
+							t.Errorf("%s: file renamed when should not", e.testName)
+						}
+					}
+					path := filepath.Join(uploadDir, uploadedFile.NewFileName)
+					if _, statErr := os.Stat(path); os.IsNotExist(statErr) {
+						t.Errorf("%s: expected file to exist: %s", e.testName, statErr.Error())
+					} else {
+						_ = os.Remove(path)
+					}
+				}
+			}
+			pr.Close()
+			wg.Wait()
+		})
+	}
+}
+
+func TestTools_UploadOneFile_NoFile(t *testing.T) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	if err := writer.WriteField("title", "no file here"); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	request := httptest.NewRequest("POST", "/", body)
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+
+	var testTools Tools
+	uploadedFile, err := testTools.UploadOneFile(request, t.TempDir())
+	if err == nil {
+		t.Fatal("expected an error when no file is uploaded, got nil")
+	}
+
+	if err.Error() != "no file uploaded" {
+		t.Errorf("unexpected error message: %s", err.Error())
+	}
+
+	if uploadedFile != nil {
+		t.Errorf("expected nil uploaded file, got %+v", uploadedFile)
+	}
+}
+
+func TestTools_CreateDirIfNotExists(t *testing.T) {
+    var testTools Tools
+
+    parentDir := t.TempDir()
+
+    var testDirs = []struct {
+        testName     string
+        expectsError bool
+        dirName      string
+        mode         os.FileMode
+    }{
+        {"creates dir", false, filepath.Join(parentDir, "newDir"), 0755},
+        {"directory already exists", false, filepath.Join(parentDir, "existingDir"), 0755},
+        {"creates subdirectory", false, filepath.Join(parentDir, "sub/level/dir"), 0755},
+        {"invalid path error", true, filepath.Join(parentDir, "invalid\x00path"), 0755},
+    }
+
+    _ = os.Mkdir(filepath.Join(parentDir, "existingDir"), 0755)
+
+    for _, e := range testDirs {
+        t.Run(e.testName, func(t *testing.T) {
+            err := testTools.CreateDirIfNotExists(e.dirName, e.mode)
+            
+            if err != nil && !e.expectsError {
+                t.Errorf("%s: expected no error, but found: %v", e.testName, err)
+            }
+
+            if err == nil && e.expectsError {
+                t.Errorf("%s: expected an error, but got nil", e.testName)
+            }
+        })
+    }
+}
+
+func TestTools_CreateDirIfNotExists_PathIsFile(t *testing.T) {
+	var testTools Tools
+
+	path := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := testTools.CreateDirIfNotExists(path, 0755)
+	if !errors.Is(err, ErrNotDirectory) {
+		t.Fatalf("expected ErrNotDirectory, got %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "path exists but is not a directory") {
+		t.Errorf("expected a clear error message, got %q", err.Error())
+	}
+}
+
+func TestTools_CopyDir(t *testing.T) {
+	var testTools Tools
+
+	src := t.TempDir()
+	files := map[string]string{
+		"root.txt":               "root file",
+		"sub/nested.txt":         "nested file",
+		"sub/deeper/deepest.txt": "deepest file",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Symlink(filepath.Join(src, "root.txt"), filepath.Join(src, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		testName string
+		dst      string
+	}{
+		{"new destination", filepath.Join(t.TempDir(), "copy")},
+		{"existing destination", t.TempDir()},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			if err := testTools.CopyDir(src, tc.dst, 0755); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for name, content := range files {
+				got, err := os.ReadFile(filepath.Join(tc.dst, name))
+				if err != nil {
+					t.Errorf("expected %s to be copied: %v", name, err)
+					continue
+				}
+
+				if string(got) != content {
+					t.Errorf("%s: expected content %q, got %q", name, content, string(got))
+				}
+			}
+
+			if _, err := os.Lstat(filepath.Join(tc.dst, "link.txt")); !os.IsNotExist(err) {
+				t.Error("expected symlink to be skipped")
+			}
+		})
+	}
+
+	if err := testTools.CopyDir(filepath.Join(src, "missing"), t.TempDir(), 0755); err == nil {
+		t.Error("expected an error when the source does not exist")
+	}
+
+	for _, dst := range []string{src, filepath.Join(src, "sub", "copy")} {
+		if err := testTools.CopyDir(src, dst, 0755); err == nil {
+			t.Errorf("expected an error when copying %s into %s", src, dst)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(src, "sub", "copy")); !os.IsNotExist(err) {
+		t.Error("expected nothing to be copied into the source")
+	}
+}
+
+func TestTools_RemoveDirContents(t *testing.T) {
+	var testTools Tools
+
+	dir := filepath.Join(t.TempDir(), "uploads")
+	if err := os.MkdirAll(filepath.Join(dir, "sub", "deeper"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a.txt", "sub/b.txt", "sub/deeper/c.txt", ".hidden"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := testTools.RemoveDirContents(dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("expected top directory to remain: %v", err)
+	}
+
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("expected directory permissions to be preserved, got %v", info.Mode().Perm())
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("expected directory to be empty, found %d entries", len(entries))
+	}
+
+	if err := testTools.RemoveDirContents(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
+
+func TestTools_DirSize(t *testing.T) {
+	var testTools Tools
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub", "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]int{
+		"a.bin":     100,
+		"sub/b.bin": 2048,
+		"sub/c.bin": 1,
+	}
+
+	var expected int64
+	for name, size := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		expected += int64(size)
+	}
+
+	size, err := testTools.DirSize(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if size != expected {
+		t.Errorf("expected size %d, got %d", expected, size)
+	}
+
+	if _, err := testTools.DirSize(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
+
+var slugTestTable = []struct {
+	testName       string
+	expectsError   bool
+	errorMsg       string
+	stringToSlugfy string
+	expectedSlug   string
+}{
+	{"simple slug transformation", false, "", "hello World 123", "hello-world-123"},
+	{"all caps string", false, "", "HELLO WORLD ", "hello-world"},
+	{"exclamation sign", false, "", "HELLO WORLD!", "hello-world"},
+	{"empty slug after slugfy string", true, "empty string, after slug process", "!*%.", ""},
+	{"empty string not allowed", true, "empty string not allowed", "", ""},
+	{"portuguese accents", false, "", "Café São Paulo", "cafe-sao-paulo"},
+	{"upper case accents", false, "", "ÁGUA ÉPICA ÇÃO", "agua-epica-cao"},
+	{"german sharp s", false, "", "Straße Größe", "strasse-grosse"},
+	{"mixed latin characters", false, "", "Crème brûlée à la Łódź", "creme-brulee-a-la-lodz"},
+}
+
+func TestTools_Slugfy(t *testing.T) {
+	var testTools Tools
+	for _, e := range slugTestTable {
+		t.Run(e.testName, func(t *testing.T) {
+			slug, err := testTools.Slugfy(e.stringToSlugfy)
+			if err != nil && !e.expectsError {
+				t.Error("unexpected error for test", e.testName, "error:", err)
+			}
+
+			if err == nil && e.expectsError {
+				t.Error("expected error for test", e.testName, "error:", e.errorMsg, "but none found")
+			}
+
+			if err != nil && e.errorMsg != err.Error() {
+				t.Error("unexpected error message for test", e.testName, "expected error message:", e.errorMsg, "found:", err.Error())
+			}
+
+			if slug != e.expectedSlug {
+				t.Error("unexpected slug for test", e.testName, "expected slug:", e.expectedSlug, "slug received:", slug)
+			}
+		})
+	}
+}
+
+func TestTools_Slugfy_MaxSlugLength(t *testing.T) {
+	testCases := []struct {
+		testName      string
+		maxSlugLength int
+		input         string
+		expectedSlug  string
+	}{
+		{"unlimited", 0, "hello world again", "hello-world-again"},
+		{"shorter than limit", 50, "hello world again", "hello-world-again"},
+		{"limit lands on boundary", 11, "hello world again", "hello-world"},
+		{"limit lands inside a word", 14, "hello world again", "hello-world"},
+		{"limit lands on separator", 12, "hello world again", "hello-world"},
+		{"single long word is hard-truncated", 5, "supercalifragilistic", "super"},
+		{"long first word is hard-truncated", 5, "supercalifragilistic word", "super"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			testTools := Tools{MaxSlugLength: tc.maxSlugLength}
+
+			slug, err := testTools.Slugfy(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if slug != tc.expectedSlug {
+				t.Errorf("expected slug %q, got %q", tc.expectedSlug, slug)
+			}
+		})
+	}
+}
+
+func TestTools_Slugfy_SlugSeparator(t *testing.T) {
+	testCases := []struct {
+		testName     string
+		separator    string
+		input        string
+		expectedSlug string
+	}{
+		{"default separator", "", "hello world", "hello-world"},
+		{"underscore separator", "_", "hello world", "hello_world"},
+		{"collapses repeated separators", "_", "hello __ -- world!!", "hello_world"},
+		{"trims leading and trailing separators", "_", "  _hello world_ ", "hello_world"},
+		{"multi-character separator", "--", "hello world", "hello--world"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			testTools := Tools{SlugSeparator: tc.separator}
+
+			slug, err := testTools.Slugfy(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if slug != tc.expectedSlug {
+				t.Errorf("expected slug %q, got %q", tc.expectedSlug, slug)
+			}
+		})
+	}
+}
+
+func TestTools_SlugfyUnicode(t *testing.T) {
+	testCases := []struct {
+		testName      string
+		maxSlugLength int
+		input         string
+		expectedSlug  string
+		expectsError  bool
+	}{
+		{"cyrillic", 0, "Привет, мир!", "привет-мир", false},
+		{"japanese", 0, "こんにちは 世界", "こんにちは-世界", false},
+		{"mixed scripts and digits", 0, "Go 言語 2025", "go-言語-2025", false},
+		{"latin accents are kept", 0, "Olá Mundo", "olá-mundo", false},
+		{"combining marks are kept", 0, "हिन्दी भाषा", "हिन्दी-भाषा", false},
+		{"leading combining mark is dropped", 0, "\u0301abc", "abc", false},
+		{"truncates at word boundary", 15, "привет мир снова", "привет", false},
+		{"hard-truncates at rune boundary", 5, "привет", "пр", false},
+		{"truncated to nothing", 1, "привет", "", true},
+		{"only punctuation", 0, "!!! ---", "", true},
+		{"empty string", 0, "", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			testTools := Tools{MaxSlugLength: tc.maxSlugLength}
+
+			slug, err := testTools.SlugfyUnicode(tc.input)
+			if tc.expectsError {
+				if err == nil {
+					t.Errorf("expected an error, got slug %q", slug)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if slug != tc.expectedSlug {
+				t.Errorf("expected slug %q, got %q", tc.expectedSlug, slug)
+			}
+		})
+	}
+}
+
+func TestTools_SlugfyBatch(t *testing.T) {
+	var testTools Tools
+
+	slugs, err := testTools.SlugfyBatch([]string{
+		"Hello World",
+		"Another Post",
+		"hello world!",
+		"Hello, World",
+		"Hello World 2",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"hello-world", "another-post", "hello-world-2", "hello-world-3", "hello-world-2-2"}
+	if !slices.Equal(slugs, expected) {
+		t.Errorf("expected %v, got %v", expected, slugs)
+	}
+
+	t.Run("custom separator", func(t *testing.T) {
+		testTools := Tools{SlugSeparator: "_"}
+
+		slugs, err := testTools.SlugfyBatch([]string{"a b", "a b"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if !slices.Equal(slugs, []string{"a_b", "a_b_2"}) {
+			t.Errorf("expected [a_b a_b_2], got %v", slugs)
+		}
+	})
+
+	t.Run("invalid input", func(t *testing.T) {
+		_, err := testTools.SlugfyBatch([]string{"fine", "!!!"})
+		if err == nil || !strings.Contains(err.Error(), "input 1") {
+			t.Errorf("expected an error naming input 1, got %v", err)
+		}
+	})
+}
+
+func TestTools_SlugfyUnique(t *testing.T) {
+	var testTools Tools
+	dir := t.TempDir()
+
+	slug, err := testTools.SlugfyUnique("My Post", dir, ".md")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if slug != "my-post" {
+		t.Errorf("expected my-post when no file exists, got %s", slug)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "my-post.md"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	slug, err = testTools.SlugfyUnique("My Post", dir, ".md")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if slug != "my-post-2" {
+		t.Errorf("expected my-post-2 when the base name exists, got %s", slug)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "my-post-2.md"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	slug, err = testTools.SlugfyUnique("My Post", dir, "md")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if slug != "my-post-3" {
+		t.Errorf("expected my-post-3 when the -2 variant exists, got %s", slug)
+	}
+
+	if _, err := testTools.SlugfyUnique("", dir, ".md"); err == nil {
+		t.Error("expected an error for an empty string")
+	}
+}
+
+func TestTools_DownloadStaticFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	fileName := "testfile.txt"
+	content := []byte("conteúdo do arquivo de teste")
+	filePath := filepath.Join(tmpDir, fileName)
+
+	if err := os.WriteFile(filePath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	displayName := "meu-download.txt"
+	tools := New()
+
+	req := httptest.NewRequest("GET", "/download", nil)
+	rr := httptest.NewRecorder()
+
+	tools.DownloadStaticFile(rr, req, tmpDir, fileName, displayName)
+
+	if rr.Code != 200 {
+		t.Errorf("esperava status 200, recebeu %d", rr.Code)
+	}
+
+	expectedHeader := fmt.Sprintf("attachment; filename=\"%s\"", displayName)
+	if got := rr.Header().Get("Content-Disposition"); got != expectedHeader {
+		t.Errorf("cabeçalho Content-Disposition incorreto: esperado %s, recebeu %s", expectedHeader, got)
+	}
+
+	if rr.Body.String() != string(content) {
+		t.Errorf("conteúdo do arquivo incorreto: esperado %s, recebeu %s", string(content), rr.Body.String())
+	}
+}
+
+func TestTools_DownloadStaticFile_Range(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := []byte("0123456789abcdefghij")
+	if err := os.WriteFile(filepath.Join(tmpDir, "range.txt"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name                string
+		inline              []bool
+		expectedDisposition string
+	}{
+		{"attachment by default", nil, `attachment; filename="partial.txt"`},
+		{"inline disposition", []bool{true}, `inline; filename="partial.txt"`},
+	}
+
+	tools := New()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/download", nil)
+			req.Header.Set("Range", "bytes=0-9")
+			rr := httptest.NewRecorder()
+
+			tools.DownloadStaticFile(rr, req, tmpDir, "range.txt", "partial.txt", tc.inline...)
+
+			if rr.Code != http.StatusPartialContent {
+				t.Errorf("expected status 206, got %d", rr.Code)
+			}
+
+			if got := rr.Header().Get("Content-Disposition"); got != tc.expectedDisposition {
+				t.Errorf("expected Content-Disposition %s, got %s", tc.expectedDisposition, got)
+			}
+
+			if rr.Body.String() != "0123456789" {
+				t.Errorf("expected partial content 0123456789, got %s", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestTools_DownloadStaticFile_ETag(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "cached.txt"), []byte("cache me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tools := New()
+
+	rr := httptest.NewRecorder()
+	tools.DownloadStaticFile(rr, httptest.NewRequest("GET", "/download", nil), tmpDir, "cached.txt", "cached.txt")
+
+	etag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected status 200 with an ETag, got %d and %q", rr.Code, etag)
+	}
+
+	req := httptest.NewRequest("GET", "/download", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	tools.DownloadStaticFile(rr, req, tmpDir, "cached.txt", "cached.txt")
+
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected status 304 for a matching If-None-Match, got %d", rr.Code)
+	}
+
+	if rr.Body.Len() != 0 {
+		t.Errorf("expected no body on 304, got %q", rr.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/download", nil)
+	req.Header.Set("If-None-Match", `"stale"`)
+	rr = httptest.NewRecorder()
+	tools.DownloadStaticFile(rr, req, tmpDir, "cached.txt", "cached.txt")
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status 200 for a stale If-None-Match, got %d", rr.Code)
+	}
+}
+
+func TestTools_DownloadStaticFile_ContentTypeOverrides(t *testing.T) {
+	tmpDir := t.TempDir()
+	for name, content := range map[string]string{
+		"map.geojson": `{"type": "FeatureCollection", "features": []}`,
+		"MAP.GEOJSON": `{"type": "FeatureCollection", "features": []}`,
+		"notes.html":  "<p>notes</p>",
+	} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tools := Tools{ContentTypeOverrides: map[string]string{".geojson": "application/geo+json"}}
+
+	testCases := []struct {
+		file                string
+		expectedContentType string
+	}{
+		{"map.geojson", "application/geo+json"},
+		{"MAP.GEOJSON", "application/geo+json"},
+		{"notes.html", "text/html; charset=utf-8"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.file, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			tools.DownloadStaticFile(rr, httptest.NewRequest("GET", "/download", nil), tmpDir, tc.file, tc.file)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", rr.Code)
+			}
+
+			if got := rr.Header().Get("Content-Type"); got != tc.expectedContentType {
+				t.Errorf("expected Content-Type %s, got %s", tc.expectedContentType, got)
+			}
+		})
+	}
+}
+
+func TestTools_DownloadStaticFile_Traversal(t *testing.T) {
+	root := t.TempDir()
+	publicDir := filepath.Join(root, "public")
+	if err := os.Mkdir(publicDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "secret.txt"), []byte("top secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name string
+		file string
+	}{
+		{"parent directory", "../secret.txt"},
+		{"nested traversal", "sub/../../secret.txt"},
+		{"deep traversal", "../../../../etc/passwd"},
+	}
+
+	tools := New()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/download", nil)
+			rr := httptest.NewRecorder()
+
+			tools.DownloadStaticFile(rr, req, publicDir, tc.file, "secret.txt")
+
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", rr.Code)
+			}
+
+			if strings.Contains(rr.Body.String(), "top secret") {
+				t.Error("file outside of the download directory was served")
+			}
+
+			if rr.Header().Get("Content-Disposition") != "" {
+				t.Error("Content-Disposition should not be set for rejected paths")
+			}
+		})
+	}
+}
+
+func TestTools_SignedURL(t *testing.T) {
+	var testTools Tools
+	secret := "s3cret"
+
+	valid := testTools.SignedURL("/files/report.pdf", secret, time.Now().Add(time.Hour))
+	expired := testTools.SignedURL("/files/report.pdf", secret, time.Now().Add(-time.Minute))
+
+	var tests = []struct {
+		name         string
+		url          string
+		secret       string
+		expectsValid bool
+	}{
+		{"valid signature", valid, secret, true},
+		{"expired signature", expired, secret, false},
+		{"tampered path", strings.Replace(valid, "report.pdf", "salaries.pdf", 1), secret, false},
+		{"tampered expiry", strings.Replace(expired, "expires=", "expires=9", 1), secret, false},
+		{"wrong secret", valid, "other", false},
+		{"unsigned url", "/files/report.pdf", secret, false},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			ok, err := testTools.VerifySignedURL(e.url, e.secret)
+
+			if ok != e.expectsValid {
+				t.Errorf("expected valid to be %v for %s, got %v (%v)", e.expectsValid, e.url, ok, err)
+			}
+
+			if !ok && err == nil {
+				t.Error("expected an error explaining the invalid url, got nil")
+			}
+		})
+	}
+
+	withQuery := testTools.SignedURL("/files/report.pdf?version=2", secret, time.Now().Add(time.Hour))
+	if !strings.Contains(withQuery, "version=2") {
+		t.Errorf("expected existing query to be kept, got %s", withQuery)
+	}
+
+	if ok, err := testTools.VerifySignedURL(withQuery, secret); !ok {
+		t.Errorf("expected url with existing query to be valid, got %v", err)
+	}
+
+	download := testTools.SignedURL("/download?file=public.txt", secret, time.Now().Add(time.Hour))
+	for _, tampered := range []string{
+		strings.Replace(download, "file=public.txt", "file=secret.txt", 1),
+		download + "&file=secret.txt",
+		download + "&extra=1",
+	} {
+		if ok, _ := testTools.VerifySignedURL(tampered, secret); ok {
+			t.Errorf("expected url with tampered query to be invalid: %s", tampered)
+		}
+	}
+}
+
+func TestTools_DownloadStaticFile_DownloadSecret(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "report.pdf"), []byte("report"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tools := Tools{DownloadSecret: "s3cret"}
+
+	var tests = []struct {
+		name           string
+		url            string
+		expectedStatus int
+	}{
+		{"signed request", tools.SignedURL("/download/report.pdf", "s3cret", time.Now().Add(time.Hour)), http.StatusOK},
+		{"expired request", tools.SignedURL("/download/report.pdf", "s3cret", time.Now().Add(-time.Hour)), http.StatusForbidden},
+		{"unsigned request", "/download/report.pdf", http.StatusForbidden},
+		{"tampered query", strings.Replace(tools.SignedURL("/download?file=public.pdf", "s3cret", time.Now().Add(time.Hour)), "file=public.pdf", "file=report.pdf", 1), http.StatusForbidden},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			tools.DownloadStaticFile(rr, httptest.NewRequest("GET", e.url, nil), tmpDir, "report.pdf", "report.pdf")
+
+			if rr.Code != e.expectedStatus {
+				t.Errorf("expected status %d, got %d", e.expectedStatus, rr.Code)
+			}
+		})
+	}
+}
+
+func TestTools_DownloadStream(t *testing.T) {
+	content := "id,name\n1,foo\n2,bar\n"
+
+	testCases := []struct {
+		name                  string
+		contentType           string
+		size                  []int64
+		expectedContentType   string
+		expectedContentLength string
+	}{
+		{"csv with size", "text/csv", []int64{int64(len(content))}, "text/csv", strconv.Itoa(len(content))},
+		{"default content type without size", "", nil, "application/octet-stream", ""},
+	}
+
+	tools := New()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/export", nil)
+			rr := httptest.NewRecorder()
+
+			err := tools.DownloadStream(rr, req, bytes.NewBufferString(content), "export.csv", tc.contentType, tc.size...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := rr.Header().Get("Content-Disposition"); got != `attachment; filename="export.csv"` {
+				t.Errorf("unexpected Content-Disposition: %s", got)
+			}
+
+			if got := rr.Header().Get("Content-Type"); got != tc.expectedContentType {
+				t.Errorf("expected Content-Type %s, got %s", tc.expectedContentType, got)
+			}
+
+			if got := rr.Header().Get("Content-Length"); got != tc.expectedContentLength {
+				t.Errorf("expected Content-Length %q, got %q", tc.expectedContentLength, got)
+			}
+
+			if rr.Body.String() != content {
+				t.Errorf("expected body %q, got %q", content, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestTools_DownloadBytes(t *testing.T) {
+	var testTools Tools
+	csv := []byte("id,name\n1,foo\n2,bar\n")
+
+	testCases := []struct {
+		name                string
+		contentType         []string
+		expectedContentType string
+	}{
+		{"detected content type", nil, "text/plain; charset=utf-8"},
+		{"explicit content type", []string{"text/csv"}, "text/csv"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			if err := testTools.DownloadBytes(rr, csv, "export.csv", tc.contentType...); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := rr.Header().Get("Content-Disposition"); got != `attachment; filename="export.csv"` {
+				t.Errorf("unexpected Content-Disposition: %s", got)
+			}
+
+			if got := rr.Header().Get("Content-Type"); got != tc.expectedContentType {
+				t.Errorf("expected Content-Type %s, got %s", tc.expectedContentType, got)
+			}
+
+			if got := rr.Header().Get("Content-Length"); got != strconv.Itoa(len(csv)) {
+				t.Errorf("expected Content-Length %d, got %s", len(csv), got)
+			}
+
+			if !bytes.Equal(rr.Body.Bytes(), csv) {
+				t.Errorf("expected body %q, got %q", csv, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestTools_StaticHandler(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"app.js":             "console.log('hi')",
+		"docs/index.html":    "<h1>docs</h1>",
+		"images/logo.txt":    "logo",
+		".env":               "SECRET=1",
+		".git/config":        "[core]",
+		"assets/.hidden.css": "body {}",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var testTools Tools
+
+	var tests = []struct {
+		name           string
+		path           string
+		opts           []StaticOptions
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"file", "/app.js", nil, http.StatusOK, "console.log('hi')"},
+		{"directory with index", "/docs/", nil, http.StatusOK, "<h1>docs</h1>"},
+		{"directory without index", "/images/", nil, http.StatusNotFound, ""},
+		{"root without index", "/", nil, http.StatusNotFound, ""},
+		{"dotfile", "/.env", nil, http.StatusNotFound, ""},
+		{"file in dot directory", "/.git/config", nil, http.StatusNotFound, ""},
+		{"nested dotfile", "/assets/.hidden.css", nil, http.StatusNotFound, ""},
+		{"dotfile through traversal", "/assets/../.env", nil, http.StatusNotFound, ""},
+		{"dotfiles allowed", "/.env", []StaticOptions{{AllowDotfiles: true}}, http.StatusOK, "SECRET=1"},
+		{"missing file", "/missing.js", nil, http.StatusNotFound, ""},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.URL.Path = e.path
+			rr := httptest.NewRecorder()
+
+			testTools.StaticHandler(dir, e.opts...).ServeHTTP(rr, req)
+
+			if rr.Code != e.expectedStatus {
+				t.Errorf("expected status %d, got %d", e.expectedStatus, rr.Code)
+			}
+
+			if e.expectedBody != "" && rr.Body.String() != e.expectedBody {
+				t.Errorf("expected body %q, got %q", e.expectedBody, rr.Body.String())
+			}
+
+			if strings.Contains(rr.Body.String(), "SECRET") && e.expectedStatus != http.StatusOK {
+				t.Error("dotfile content was served")
+			}
+		})
+	}
+}
+
+func TestTools_RunServer(t *testing.T) {
+	tools := &Tools{}
+
+	t.Run("Graceful Shutdown via Context", func(t *testing.T) {
+		// Use an available port for testing
+		srv := &http.Server{
+			Addr: "localhost:8081",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}),
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
 
 		// Channel to capture the error from RunServer
 		errChan := make(chan error)
 
-		go func() {
-			errChan <- tools.RunServer(ctx, srv, 2*time.Second)
+		go func() {
+			errChan <- tools.RunServer(ctx, srv, 2*time.Second)
+		}()
+
+		// Give the server a moment to start
+		time.Sleep(100 * time.Millisecond)
+
+		// Trigger shutdown via context
+		cancel()
+
+		select {
+		case err := <-errChan:
+			if err != nil {
+				t.Errorf("expected nil error on graceful shutdown, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("server did not shut down within timeout")
+		}
+	})
+
+	t.Run("Server Port Conflict", func(t *testing.T) {
+		// Start a dummy listener on a port
+		srv1 := &http.Server{Addr: "localhost:8082"}
+		go srv1.ListenAndServe()
+		defer srv1.Close()
+
+		time.Sleep(100 * time.Millisecond)
+
+		// Try to start our server on the same port
+		srv2 := &http.Server{Addr: "localhost:8082"}
+		ctx := context.Background()
+
+		err := tools.RunServer(ctx, srv2, 1*time.Second)
+		if err == nil {
+			t.Error("expected an error due to port conflict, got nil")
+		}
+	})
+
+	t.Run("OnReady Callback", func(t *testing.T) {
+		ready := make(chan struct{})
+		tools := &Tools{OnReady: func() { close(ready) }}
+
+		srv := &http.Server{
+			Addr: "localhost:8083",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			}),
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errChan := make(chan error, 1)
+
+		go func() {
+			errChan <- tools.RunServer(ctx, srv, 2*time.Second)
+		}()
+
+		select {
+		case <-ready:
+		case <-time.After(2 * time.Second):
+			t.Fatal("OnReady was not called")
+		}
+
+		resp, err := http.Get("http://localhost:8083/")
+		if err != nil {
+			t.Fatalf("server not reachable after OnReady: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusTeapot {
+			t.Errorf("expected status 418, got %d", resp.StatusCode)
+		}
+
+		cancel()
+		if err := <-errChan; err != nil {
+			t.Errorf("expected nil error, got %v", err)
+		}
+	})
+
+	t.Run("OnShutdown Hook", func(t *testing.T) {
+		hookErr := errors.New("failed to flush logs")
+
+		var hasDeadline bool
+		tools := &Tools{OnShutdown: func(ctx context.Context) error {
+			_, hasDeadline = ctx.Deadline()
+			return hookErr
+		}}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errChan := make(chan error, 1)
+
+		go func() {
+			errChan <- tools.RunServer(ctx, &http.Server{Addr: "localhost:0"}, 2*time.Second)
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+
+		err := <-errChan
+		if !errors.Is(err, hookErr) {
+			t.Errorf("expected the hook error to be returned, got %v", err)
+		}
+
+		if !hasDeadline {
+			t.Error("expected the hook to get a context bound by the shutdown timeout")
+		}
+	})
+
+	t.Run("OnShutdown Hook After Serve Error", func(t *testing.T) {
+		var called bool
+		tools := &Tools{OnShutdown: func(ctx context.Context) error {
+			called = true
+			return nil
+		}}
+
+		// a cipher suite list without the one HTTP/2 requires makes ServeTLS fail once listening
+		srv := &http.Server{
+			Addr: "localhost:0",
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{{}},
+				CipherSuites: []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA},
+			},
+		}
+
+		if err := tools.RunServer(context.Background(), srv, 2*time.Second); err == nil {
+			t.Fatal("expected the serve error to be returned, got nil")
+		}
+
+		if !called {
+			t.Error("expected OnShutdown to be called after the serve error")
+		}
+	})
+
+	t.Run("Custom Logger", func(t *testing.T) {
+		logs := new(bytes.Buffer)
+		tools := &Tools{Logger: slog.New(slog.NewTextHandler(logs, nil))}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errChan := make(chan error, 1)
+
+		go func() {
+			errChan <- tools.RunServer(ctx, &http.Server{Addr: "localhost:0"}, 2*time.Second)
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+
+		if err := <-errChan; err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+
+		for _, msg := range []string{"starting HTTP server", "context canceled", "server exited gracefully"} {
+			if !contains(logs.String(), msg) {
+				t.Errorf("expected logs to contain %q, got %q", msg, logs.String())
+			}
+		}
+	})
+
+	t.Run("Startup Error With Canceled Context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		srv := &http.Server{Addr: "invalid-address"}
+
+		err := tools.RunServer(ctx, srv, time.Second)
+		if err == nil {
+			t.Fatal("expected the bind error to be returned, got nil")
+		}
+
+		if !contains(err.Error(), "invalid-address") {
+			t.Errorf("expected bind error for invalid-address, got %v", err)
+		}
+	})
+
+	t.Run("TLS Error With Canceled Context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		srv := &http.Server{Addr: "localhost:0"}
+
+		err := tools.RunServer(ctx, srv, time.Second, "missing-cert.pem", "missing-key.pem")
+		if err == nil {
+			t.Fatal("expected the certificate error to be returned, got nil")
+		}
+	})
+
+	t.Run("Graceful Shutdown via Signal Agnostic", func(t *testing.T) {
+		tools := &Tools{}
+
+		testChan := make(chan os.Signal, 1)
+		tools.signalChan = testChan
+
+		srv := &http.Server{Addr: "localhost:0"}
+		errChan := make(chan error, 1)
+
+		go func() {
+			errChan <- tools.RunServer(context.Background(), srv, 2*time.Second)
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+
+		testChan <- os.Interrupt
+
+		select {
+		case err := <-errChan:
+			if err != nil {
+				t.Errorf("expected nil error, got %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Error("server did not respond to injected signal")
+		}
+	})
+
+	t.Run("Graceful Shutdown via Custom Signal", func(t *testing.T) {
+		tools := &Tools{ShutdownSignals: []os.Signal{syscall.SIGHUP}}
+
+		// keep the test process alive should the signal arrive before RunServer listens for it
+		guard := make(chan os.Signal, 1)
+		signal.Notify(guard, syscall.SIGHUP)
+		defer signal.Stop(guard)
+
+		srv := &http.Server{Addr: "localhost:0"}
+		errChan := make(chan error, 1)
+
+		go func() {
+			errChan <- tools.RunServer(context.Background(), srv, 2*time.Second)
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+
+		proc, err := os.FindProcess(os.Getpid())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := proc.Signal(syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case err := <-errChan:
+			if err != nil {
+				t.Errorf("expected nil error, got %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Error("server did not respond to the configured signal")
+		}
+	})
+
+	t.Run("Repeated Runs Respond to Signals", func(t *testing.T) {
+		tools := &Tools{ShutdownSignals: []os.Signal{syscall.SIGHUP}}
+
+		guard := make(chan os.Signal, 1)
+		signal.Notify(guard, syscall.SIGHUP)
+		defer signal.Stop(guard)
+
+		proc, err := os.FindProcess(os.Getpid())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for run := 1; run <= 2; run++ {
+			srv := &http.Server{Addr: "localhost:0"}
+			errChan := make(chan error, 1)
+
+			go func() {
+				errChan <- tools.RunServer(context.Background(), srv, 2*time.Second)
+			}()
+
+			time.Sleep(100 * time.Millisecond)
+
+			if err := proc.Signal(syscall.SIGHUP); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case err := <-errChan:
+				if err != nil {
+					t.Errorf("run %d: expected nil error, got %v", run, err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("run %d: server did not respond to the signal", run)
+			}
+		}
+	})
+}
+
+// writeTestCert writes a self-signed certificate for localhost with the given serial number, and its key
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTools_RunServer_CertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, 1)
+
+	// reserve a free port, so the test knows where to connect
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ready := make(chan struct{})
+	tools := &Tools{OnReady: func() { close(ready) }}
+	srv := &http.Server{Addr: addr}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- tools.RunServer(ctx, srv, 2*time.Second, certFile, keyFile)
+	}()
+
+	select {
+	case <-ready:
+	case err := <-errChan:
+		t.Fatalf("server failed to start: %v", err)
+	}
+
+	servedSerial := func() int64 {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	if serial := servedSerial(); serial != 1 {
+		t.Errorf("expected certificate 1 to be served, got %d", serial)
+	}
+
+	writeTestCert(t, certFile, keyFile, 2)
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if serial := servedSerial(); serial != 2 {
+		t.Errorf("expected renewed certificate 2 to be served, got %d", serial)
+	}
+
+	cancel()
+	if err := <-errChan; err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+}
+
+func TestTools_RunServers(t *testing.T) {
+	t.Run("Graceful Shutdown via Context", func(t *testing.T) {
+		var ready sync.WaitGroup
+		ready.Add(2)
+		tools := &Tools{OnReady: ready.Done}
+
+		// shutdown hooks run in their own goroutines, so they are collected through a channel
+		shutdowns := make(chan struct{}, 2)
+		servers := make([]*http.Server, 2)
+		for i := range servers {
+			servers[i] = &http.Server{Addr: "localhost:0"}
+			servers[i].RegisterOnShutdown(func() { shutdowns <- struct{}{} })
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errChan := make(chan error, 1)
+
+		go func() {
+			errChan <- tools.RunServers(ctx, 2*time.Second, servers...)
+		}()
+
+		ready.Wait()
+		cancel()
+
+		select {
+		case err := <-errChan:
+			if err != nil {
+				t.Errorf("expected nil error on graceful shutdown, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("servers did not shut down within timeout")
+		}
+
+		for i := range servers {
+			select {
+			case <-shutdowns:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("expected both servers to shut down, got %d", i)
+			}
+		}
+	})
+
+	t.Run("OnShutdown Called Once", func(t *testing.T) {
+		var ready sync.WaitGroup
+		ready.Add(2)
+
+		var calls atomic.Int32
+		tools := &Tools{
+			OnReady: ready.Done,
+			OnShutdown: func(ctx context.Context) error {
+				calls.Add(1)
+				return nil
+			},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errChan := make(chan error, 1)
+
+		go func() {
+			errChan <- tools.RunServers(ctx, 2*time.Second, &http.Server{Addr: "localhost:0"}, &http.Server{Addr: "localhost:0"})
+		}()
+
+		ready.Wait()
+		cancel()
+
+		if err := <-errChan; err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+
+		if n := calls.Load(); n != 1 {
+			t.Errorf("expected OnShutdown to be called once, got %d", n)
+		}
+	})
+
+	t.Run("Failing Server Stops The Others", func(t *testing.T) {
+		tools := &Tools{}
+
+		shutdown := make(chan struct{})
+		good := &http.Server{Addr: "localhost:0"}
+		good.RegisterOnShutdown(func() { close(shutdown) })
+		bad := &http.Server{Addr: "invalid-address"}
+
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- tools.RunServers(context.Background(), 2*time.Second, good, bad)
+		}()
+
+		select {
+		case err := <-errChan:
+			if err == nil || !contains(err.Error(), "invalid-address") {
+				t.Errorf("expected the bind error to be returned, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("servers did not stop after one of them failed")
+		}
+
+		select {
+		case <-shutdown:
+		case <-time.After(2 * time.Second):
+			t.Error("expected the healthy server to shut down")
+		}
+	})
+}
+
+func TestTools_applyServerDefaults(t *testing.T) {
+	t.Run("built-in defaults only for unset fields", func(t *testing.T) {
+		tools := &Tools{}
+		srv := &http.Server{ReadTimeout: 42 * time.Second}
+
+		tools.applyServerDefaults(srv)
+
+		if srv.ReadTimeout != 42*time.Second {
+			t.Errorf("expected ReadTimeout to be kept at 42s, got %s", srv.ReadTimeout)
+		}
+
+		if srv.ReadHeaderTimeout != 5*time.Second {
+			t.Errorf("expected ReadHeaderTimeout 5s, got %s", srv.ReadHeaderTimeout)
+		}
+
+		if srv.WriteTimeout != 15*time.Second {
+			t.Errorf("expected WriteTimeout 15s, got %s", srv.WriteTimeout)
+		}
+
+		if srv.IdleTimeout != 60*time.Second {
+			t.Errorf("expected IdleTimeout 60s, got %s", srv.IdleTimeout)
+		}
+	})
+
+	t.Run("configured defaults", func(t *testing.T) {
+		tools := &Tools{ServerDefaults: ServerDefaults{
+			ReadHeaderTimeout: time.Second,
+			WriteTimeout:      2 * time.Second,
+		}}
+		srv := &http.Server{IdleTimeout: 3 * time.Second}
+
+		tools.applyServerDefaults(srv)
+
+		if srv.ReadHeaderTimeout != time.Second {
+			t.Errorf("expected ReadHeaderTimeout 1s, got %s", srv.ReadHeaderTimeout)
+		}
+
+		if srv.WriteTimeout != 2*time.Second {
+			t.Errorf("expected WriteTimeout 2s, got %s", srv.WriteTimeout)
+		}
+
+		if srv.ReadTimeout != 15*time.Second {
+			t.Errorf("expected ReadTimeout to fall back to 15s, got %s", srv.ReadTimeout)
+		}
+
+		if srv.IdleTimeout != 3*time.Second {
+			t.Errorf("expected IdleTimeout to be kept at 3s, got %s", srv.IdleTimeout)
+		}
+	})
+}
+
+func TestTools_ReadJSON(t *testing.T) {
+	tools := &Tools{}
+
+	// Define a dummy struct for testing
+	type Person struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+
+	// Table-driven tests
+	testCases := []struct {
+		name          string
+		json          string
+		maxSize       int
+		allowUnknown  bool
+		expectError   bool
+		errorContains string
+	}{
+		{
+			name:        "Valid JSON",
+			json:        `{"name": "Jack", "age": 30}`,
+			expectError: false,
+		},
+		{
+			name:          "Malformed JSON",
+			json:          `{"name": "Jack", "age": 30`, // missing closing brace
+			expectError:   true,
+			errorContains: "badly-formed JSON",
+		},
+		{
+			name:          "Incorrect Type",
+			json:          `{"name": "Jack", "age": "thirty"}`, // age should be int
+			expectError:   true,
+			errorContains: "incorrect JSON type",
+		},
+		{
+			name:          "Empty Body",
+			json:          ``,
+			expectError:   true,
+			errorContains: "body must not be empty",
+		},
+		{
+			name:          "Unknown Field (Disallowed)",
+			json:          `{"name": "Jack", "age": 30, "height": 180}`,
+			allowUnknown:  false,
+			expectError:   true,
+			errorContains: "unknown key",
+		},
+		{
+			name:         "Unknown Field (Allowed)",
+			json:         `{"name": "Jack", "age": 30, "height": 180}`,
+			allowUnknown: true,
+			expectError:  false,
+		},
+		{
+			name:          "Multiple JSON Values",
+			json:          `{"name": "Jack"}{"name": "Jill"}`,
+			expectError:   true,
+			errorContains: "only one JSON value",
+		},
+		{
+			name:          "Body Too Large",
+			json:          `{"name": "Jack", "age": 30}`,
+			maxSize:       5, // extremely small limit
+			expectError:   true,
+			errorContains: "larger than",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+
+			tools.MaxJSONSize = tc.maxSize
+			tools.AllowUnknownFields = tc.allowUnknown
+
+			// Create request
+			req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(tc.json)))
+			rr := httptest.NewRecorder()
+
+			var data Person
+			err := tools.ReadJSON(rr, req, &data)
+
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("%s: expected an error but got nil", tc.name)
+				}
+
+				if err != nil && tc.errorContains != "" {
+					if !contains(err.Error(), tc.errorContains) {
+						t.Errorf("%s: expected error to contain %q, got %q", tc.name, tc.errorContains, err.Error())
+					}
+				}
+			} else {
+				if err != nil {
+					t.Errorf("%s: expected no error but got %v", tc.name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestTools_ReadJSON_RequireJSONContentType(t *testing.T) {
+	testCases := []struct {
+		name        string
+		require     bool
+		contentType string
+		expectError bool
+	}{
+		{"json content type", true, "application/json", false},
+		{"json content type with charset", true, "application/json; charset=utf-8", false},
+		{"form content type rejected", true, "application/x-www-form-urlencoded", true},
+		{"missing content type rejected", true, "", true},
+		{"form content type allowed when not required", false, "application/x-www-form-urlencoded", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tools := &Tools{RequireJSONContentType: tc.require}
+
+			req := httptest.NewRequest("POST", "/", strings.NewReader(`{"name": "Jack"}`))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+
+			var data struct {
+				Name string `json:"name"`
+			}
+			err := tools.ReadJSON(httptest.NewRecorder(), req, &data)
+
+			if !tc.expectError {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			var jsonErr *JSONError
+			if !errors.As(err, &jsonErr) || jsonErr.Kind != JSONErrorContentType {
+				t.Errorf("expected a *JSONError of kind JSONErrorContentType, got %v", err)
+			}
+		})
+	}
+}
+
+func TestTools_DecodeJSON(t *testing.T) {
+	type Person struct {
+		Name string `json:"name"`
+	}
+
+	testCases := []struct {
+		name     string
+		json     string
+		opts     []DecodeOptions
+		expected JSONErrorKind
+		wantErr  bool
+	}{
+		{name: "valid", json: `{"name": "Jack"}`},
+		{name: "trailing data", json: `{"name": "Jack"} {"name": "Jill"}`, expected: JSONErrorMultiple, wantErr: true},
+		{name: "empty", json: ``, expected: JSONErrorEmpty, wantErr: true},
+		{name: "unknown field", json: `{"name": "Jack", "age": 30}`, expected: JSONErrorUnknownField, wantErr: true},
+		{name: "unknown field allowed", json: `{"name": "Jack", "age": 30}`, opts: []DecodeOptions{{AllowUnknownFields: true}}},
+		{name: "too large", json: `{"name": "Jack"}`, opts: []DecodeOptions{{MaxBytes: 5}}, expected: JSONErrorTooLarge, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var tools Tools
+			var person Person
+
+			err := tools.DecodeJSON(strings.NewReader(tc.json), &person, tc.opts...)
+			if !tc.wantErr {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				if person.Name != "Jack" {
+					t.Errorf("expected name Jack, got %q", person.Name)
+				}
+				return
+			}
+
+			var jsonErr *JSONError
+			if !errors.As(err, &jsonErr) || jsonErr.Kind != tc.expected {
+				t.Errorf("expected a *JSONError of kind %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestTools_ReadJSON_ErrorKind(t *testing.T) {
+	type Person struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+
+	testCases := []struct {
+		name         string
+		json         string
+		maxSize      int
+		expectedKind JSONErrorKind
+	}{
+		{"syntax", `{"name": "Jack",}`, 0, JSONErrorSyntax},
+		{"unexpected end", `{"name": "Jack"`, 0, JSONErrorSyntax},
+		{"type", `{"age": "thirty"}`, 0, JSONErrorType},
+		{"too large", `{"name": "Jack", "age": 30}`, 5, JSONErrorTooLarge},
+		{"empty", ``, 0, JSONErrorEmpty},
+		{"unknown field", `{"height": 180}`, 0, JSONErrorUnknownField},
+		{"multiple", `{"name": "Jack"}{"name": "Jill"}`, 0, JSONErrorMultiple},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tools := &Tools{MaxJSONSize: tc.maxSize}
+
+			req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(tc.json)))
+			rr := httptest.NewRecorder()
+
+			var data Person
+			err := tools.ReadJSON(rr, req, &data)
+
+			var jsonErr *JSONError
+			if !errors.As(err, &jsonErr) {
+				t.Fatalf("expected a *JSONError, got %T: %v", err, err)
+			}
+
+			if jsonErr.Kind != tc.expectedKind {
+				t.Errorf("expected kind %d, got %d (%s)", tc.expectedKind, jsonErr.Kind, jsonErr.Error())
+			}
+
+			if jsonErr.Error() == "" {
+				t.Error("expected a human-readable message")
+			}
+		})
+	}
+}
+
+func TestTools_ReadJSON_MaxJSONDepth(t *testing.T) {
+	testCases := []struct {
+		name         string
+		json         string
+		maxDepth     int
+		expectsError bool
+	}{
+		{"unlimited", strings.Repeat("[", 50) + strings.Repeat("]", 50), 0, false},
+		{"within the limit", `{"a": {"b": [1, 2, {"c": 3}]}}`, 4, false},
+		{"exactly at the limit", `[[[]]]`, 3, false},
+		{"exceeds the limit", `{"a": {"b": [1, 2, {"c": 3}]}}`, 3, true},
+		{"deeply nested arrays", strings.Repeat("[", 1000) + strings.Repeat("]", 1000), 32, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tools := &Tools{MaxJSONDepth: tc.maxDepth}
+
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tc.json))
+			rr := httptest.NewRecorder()
+
+			var data interface{}
+			err := tools.ReadJSON(rr, req, &data)
+
+			if !tc.expectsError {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			var jsonErr *JSONError
+			if !errors.As(err, &jsonErr) || jsonErr.Kind != JSONErrorTooDeep {
+				t.Fatalf("expected a JSONErrorTooDeep error, got %v", err)
+			}
+
+			expected := fmt.Sprintf("body must not be nested deeper than %d levels", tc.maxDepth)
+			if jsonErr.Error() != expected {
+				t.Errorf("expected message %q, got %q", expected, jsonErr.Error())
+			}
+		})
+	}
+
+	t.Run("other errors are still reported", func(t *testing.T) {
+		tools := &Tools{MaxJSONDepth: 5, MaxJSONSize: 10}
+
+		var jsonErr *JSONError
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{"name": "way too long"}`))
+		if err := tools.ReadJSON(httptest.NewRecorder(), req, &struct{}{}); !errors.As(err, &jsonErr) || jsonErr.Kind != JSONErrorTooLarge {
+			t.Errorf("expected a JSONErrorTooLarge error, got %v", err)
+		}
+
+		req = httptest.NewRequest("POST", "/", strings.NewReader(`{"a": }`))
+		if err := tools.ReadJSON(httptest.NewRecorder(), req, &struct{}{}); !errors.As(err, &jsonErr) || jsonErr.Kind != JSONErrorSyntax {
+			t.Errorf("expected a JSONErrorSyntax error, got %v", err)
+		}
+	})
+}
+
+func TestTools_ReadJSON_Gzip(t *testing.T) {
+	gzipped := func(t *testing.T, s string) []byte {
+		t.Helper()
+
+		buf := new(bytes.Buffer)
+		zw := gzip.NewWriter(buf)
+		if _, err := zw.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	type Person struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+
+	t.Run("gzipped body", func(t *testing.T) {
+		tools := &Tools{}
+
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(gzipped(t, `{"name": "Jack", "age": 30}`)))
+		req.Header.Set("Content-Encoding", "gzip")
+
+		var data Person
+		if err := tools.ReadJSON(httptest.NewRecorder(), req, &data); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if data.Name != "Jack" || data.Age != 30 {
+			t.Errorf("unexpected decoded data: %+v", data)
+		}
+	})
+
+	t.Run("decompressed body too large", func(t *testing.T) {
+		payload := `{"name": "` + strings.Repeat("a", 1000) + `"}`
+		body := gzipped(t, payload)
+
+		tools := &Tools{MaxJSONSize: 500}
+		if len(body) >= tools.MaxJSONSize {
+			t.Fatalf("compressed body should fit the limit, got %d bytes", len(body))
+		}
+
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", "gzip")
+
+		var data Person
+		err := tools.ReadJSON(httptest.NewRecorder(), req, &data)
+
+		var jsonErr *JSONError
+		if !errors.As(err, &jsonErr) || jsonErr.Kind != JSONErrorTooLarge {
+			t.Errorf("expected a too large error, got %v", err)
+		}
+	})
+
+	t.Run("invalid gzip data", func(t *testing.T) {
+		tools := &Tools{}
+
+		req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(`{"name": "Jack"}`)))
+		req.Header.Set("Content-Encoding", "gzip")
+
+		var data Person
+		if err := tools.ReadJSON(httptest.NewRecorder(), req, &data); err == nil {
+			t.Error("expected an error for invalid gzip data")
+		}
+	})
+}
+
+func TestTools_ReadJSON_UnknownFieldMessage(t *testing.T) {
+	tools := &Tools{}
+
+	testCases := []struct {
+		name     string
+		json     string
+		expected string
+	}{
+		{"plain name", `{"name": "Jack", "foo": 1}`, `body contains unknown key "foo"`},
+		{"name with quotes", `{"name": "Jack", "a\"b": 1}`, `body contains unknown key "a\"b"`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(tc.json)))
+			rr := httptest.NewRecorder()
+
+			var data struct {
+				Name string `json:"name"`
+			}
+
+			err := tools.ReadJSON(rr, req, &data)
+			if err == nil {
+				t.Fatal("expected an error for the unknown field, got nil")
+			}
+
+			if err.Error() != tc.expected {
+				t.Errorf("expected error message %s, got %s", tc.expected, err.Error())
+			}
+		})
+	}
+}
+
+type validatedPerson struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+func (p *validatedPerson) Validate() error {
+	if p.Age < 0 {
+		return errors.New("age must not be negative")
+	}
+	return nil
+}
+
+func TestTools_ReadJSONValidated(t *testing.T) {
+	tools := &Tools{}
+
+	testCases := []struct {
+		name          string
+		json          string
+		expectedError string
+	}{
+		{"valid payload", `{"name": "Jack", "age": 30}`, ""},
+		{"validation error", `{"name": "Jack", "age": -1}`, "age must not be negative"},
+		{"decoding error comes first", `{"name": "Jack", "age": -1`, "body contains badly-formed JSON"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(tc.json)))
+
+			var person validatedPerson
+			err := tools.ReadJSONValidated(httptest.NewRecorder(), req, &person)
+
+			if tc.expectedError == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if tc.expectedError != "" && (err == nil || err.Error() != tc.expectedError) {
+				t.Errorf("expected error %q, got %v", tc.expectedError, err)
+			}
+		})
+	}
+
+	t.Run("type without Validate", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(`{"name": "Jack"}`)))
+
+		var data struct {
+			Name string `json:"name"`
+		}
+		if err := tools.ReadJSONValidated(httptest.NewRecorder(), req, &data); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+// slowReader returns one byte of data at a time, waiting delay before each of them
+type slowReader struct {
+	data  []byte
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if len(s.data) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(s.delay)
+	p[0] = s.data[0]
+	s.data = s.data[1:]
+	return 1, nil
+}
+
+// readStopReader reads from r and closes stopped once a read fails
+type readStopReader struct {
+	r       io.ReadCloser
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func (s *readStopReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil {
+		s.once.Do(func() { close(s.stopped) })
+	}
+	return n, err
+}
+
+func (s *readStopReader) Close() error {
+	return s.r.Close()
+}
+
+func TestTools_ReadJSONTimeout(t *testing.T) {
+	var tools Tools
+
+	t.Run("within the timeout", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{"name": "Jack"}`))
+
+		var data struct {
+			Name string `json:"name"`
+		}
+		if err := tools.ReadJSONTimeout(httptest.NewRecorder(), req, &data, time.Second); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if data.Name != "Jack" {
+			t.Errorf("expected name Jack, got %q", data.Name)
+		}
+	})
+
+	t.Run("slow client", func(t *testing.T) {
+		body := &slowReader{data: []byte(`{"name": "Jack"}`), delay: 20 * time.Millisecond}
+		req := httptest.NewRequest("POST", "/", body)
+
+		start := time.Now()
+		var data map[string]string
+		err := tools.ReadJSONTimeout(httptest.NewRecorder(), req, &data, 50*time.Millisecond)
+
+		var jsonErr *JSONError
+		if !errors.As(err, &jsonErr) || jsonErr.Kind != JSONErrorTimeout {
+			t.Fatalf("expected a timeout error, got %v", err)
+		}
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Error("expected the error to wrap context.DeadlineExceeded")
+		}
+
+		if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+			t.Errorf("expected to give up after the timeout, took %v", elapsed)
+		}
+
+		if data != nil {
+			t.Errorf("expected data to be left untouched, got %v", data)
+		}
+	})
+
+	t.Run("background read stops after the timeout", func(t *testing.T) {
+		// the pipe is never written to, like a client that stops sending, and the recorder doesn't
+		// support read deadlines, so only closing the body can unblock the read
+		pr, pw := io.Pipe()
+		defer pw.Close()
+
+		body := &readStopReader{r: pr, stopped: make(chan struct{})}
+		req := httptest.NewRequest("POST", "/", body)
+
+		err := tools.ReadJSONTimeout(httptest.NewRecorder(), req, &struct{}{}, 50*time.Millisecond)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected a timeout error, got %v", err)
+		}
+
+		select {
+		case <-body.stopped:
+		case <-time.After(2 * time.Second):
+			t.Error("expected the background read to stop after the timeout")
+		}
+	})
+
+	t.Run("decode errors are still reported", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{"name": }`))
+
+		var jsonErr *JSONError
+		err := tools.ReadJSONTimeout(httptest.NewRecorder(), req, &struct{}{}, time.Second)
+		if !errors.As(err, &jsonErr) || jsonErr.Kind != JSONErrorSyntax {
+			t.Errorf("expected a syntax error, got %v", err)
+		}
+	})
+}
+
+func TestTools_ReadJSONRequire(t *testing.T) {
+	type Person struct {
+		Name  string  `json:"name"`
+		Email *string `json:"email"`
+	}
+
+	testCases := []struct {
+		name         string
+		json         string
+		expectedKind JSONErrorKind
+		errorMsg     string
+	}{
+		{"all keys present", `{"name": "Jack", "email": "jack@example.com"}`, 0, ""},
+		{"null value counts as present", `{"name": "Jack", "email": null}`, 0, ""},
+		{"missing key", `{"name": "Jack"}`, JSONErrorMissingField, `body is missing required key "email"`},
+		{"first missing key is named", `{}`, JSONErrorMissingField, `body is missing required key "name"`},
+		{"not an object", `["name", "email"]`, JSONErrorType, "body must be a JSON object"},
+		{"null body", `null`, JSONErrorType, "body must be a JSON object"},
+		{"unknown key", `{"name": "Jack", "email": null, "age": 30}`, JSONErrorUnknownField, `body contains unknown key "age"`},
+		{"bad syntax", `{"name": }`, JSONErrorSyntax, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var tools Tools
+
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tc.json))
+			rr := httptest.NewRecorder()
+
+			var person Person
+			err := tools.ReadJSONRequire(rr, req, &person, "name", "email")
+
+			if tc.expectedKind == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if person.Name != "Jack" {
+					t.Errorf("expected data to be decoded, got %+v", person)
+				}
+				return
+			}
+
+			var jsonErr *JSONError
+			if !errors.As(err, &jsonErr) || jsonErr.Kind != tc.expectedKind {
+				t.Fatalf("expected error kind %d, got %v", tc.expectedKind, err)
+			}
+
+			if tc.errorMsg != "" && jsonErr.Error() != tc.errorMsg {
+				t.Errorf("expected message %q, got %q", tc.errorMsg, jsonErr.Error())
+			}
+		})
+	}
+}
+
+func TestTools_ReadJSONStream(t *testing.T) {
+	tools := &Tools{}
+
+	body := `{"name": "Jack"} {"name": "Jill"}
+{"name": "John"}`
+	req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(body)))
+	rr := httptest.NewRecorder()
+
+	var names []string
+	err := tools.ReadJSONStream(rr, req, func(item json.RawMessage) error {
+		var person struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(item, &person); err != nil {
+			return err
+		}
+		names = append(names, person.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(names) != 3 || names[0] != "Jack" || names[1] != "Jill" || names[2] != "John" {
+		t.Errorf("expected callback to fire three times in order, got %v", names)
+	}
+
+	t.Run("callback error stops reading", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(body)))
+		calls := 0
+		stop := errors.New("stop")
+
+		err := tools.ReadJSONStream(httptest.NewRecorder(), req, func(item json.RawMessage) error {
+			calls++
+			return stop
+		})
+		if !errors.Is(err, stop) || calls != 1 {
+			t.Errorf("expected reading to stop after the first callback error, got %v after %d calls", err, calls)
+		}
+	})
+
+	t.Run("empty body", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(nil))
+
+		err := tools.ReadJSONStream(httptest.NewRecorder(), req, func(item json.RawMessage) error { return nil })
+		var jsonErr *JSONError
+		if !errors.As(err, &jsonErr) || jsonErr.Kind != JSONErrorEmpty {
+			t.Errorf("expected an empty body error, got %v", err)
+		}
+	})
+
+	t.Run("wrong content type rejected", func(t *testing.T) {
+		tools := &Tools{RequireJSONContentType: true}
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		calls := 0
+		err := tools.ReadJSONStream(httptest.NewRecorder(), req, func(item json.RawMessage) error {
+			calls++
+			return nil
+		})
+		var jsonErr *JSONError
+		if !errors.As(err, &jsonErr) || jsonErr.Kind != JSONErrorContentType || calls != 0 {
+			t.Errorf("expected a content type error before any callback, got %v after %d calls", err, calls)
+		}
+	})
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestTools_DecodeJSONArray(t *testing.T) {
+	tools := &Tools{}
+
+	var items []string
+	for i := range 1000 {
+		items = append(items, fmt.Sprintf(`{"id": %d, "name": "item %d"}`, i, i))
+	}
+	body := "[" + strings.Join(items, ",\n") + "]"
+
+	counter := &countingReader{r: strings.NewReader(body)}
+	req := httptest.NewRequest("POST", "/", counter)
+
+	calls := 0
+	readAtFirstCall := 0
+	err := tools.DecodeJSONArray(req, func(item json.RawMessage) error {
+		if calls == 0 {
+			readAtFirstCall = counter.n
+		}
+
+		var v struct {
+			ID int `json:"id"`
+		}
+		if err := json.Unmarshal(item, &v); err != nil {
+			return err
+		}
+
+		if v.ID != calls {
+			t.Errorf("expected element %d, got %d", calls, v.ID)
+		}
+		calls++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if calls != 1000 {
+		t.Errorf("expected 1000 callbacks, got %d", calls)
+	}
+
+	if readAtFirstCall >= len(body)/2 {
+		t.Errorf("expected elements to be streamed, but %d of %d bytes were read before the first one", readAtFirstCall, len(body))
+	}
+
+	testCases := []struct {
+		name         string
+		body         string
+		maxSize      int
+		expectedKind JSONErrorKind
+	}{
+		{"not an array", `{"id": 1}`, 0, JSONErrorType},
+		{"empty body", ``, 0, JSONErrorEmpty},
+		{"malformed element", `[{"id": 1}, {"id": }]`, 0, JSONErrorSyntax},
+		{"missing closing bracket", `[{"id": 1}`, 0, JSONErrorSyntax},
+		{"trailing value", `[] []`, 0, JSONErrorMultiple},
+		{"too large", body, 1024, JSONErrorTooLarge},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tools := &Tools{MaxJSONSize: tc.maxSize}
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tc.body))
+
+			err := tools.DecodeJSONArray(req, func(item json.RawMessage) error { return nil })
+
+			var jsonErr *JSONError
+			if !errors.As(err, &jsonErr) || jsonErr.Kind != tc.expectedKind {
+				t.Errorf("expected error kind %d, got %v", tc.expectedKind, err)
+			}
+		})
+	}
+
+	t.Run("callback error stops reading", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		calls := 0
+		stop := errors.New("stop")
+
+		err := tools.DecodeJSONArray(req, func(item json.RawMessage) error {
+			calls++
+			return stop
+		})
+		if !errors.Is(err, stop) || calls != 1 {
+			t.Errorf("expected reading to stop after the first callback error, got %v after %d calls", err, calls)
+		}
+	})
+}
+
+// Helper to check for substrings in errors
+func contains(s, substr string) bool {
+	return bytes.Contains([]byte(s), []byte(substr))
+}
+
+func TestTools_WriteJSON(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	payload := &JSONResponse{
+		Error:   false,
+		Message: "foo",
+	}
+
+	headers := make(http.Header)
+	headers.Add("FOO", "BAR")
+
+	err := testTools.WriteJSON(rr, http.StatusOK, payload, headers)
+	if err != nil {
+		t.Errorf("failed to write JSON: %v", err)
+	}
+
+	var got JSONResponse
+	if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+		t.Errorf("failed to decode written JSON: %v", err)
+	}
+
+	if got.Message != "foo" || got.Error {
+		t.Errorf("unexpected payload written: %+v", got)
+	}
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", rr.Code)
+	}
+
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected Content-Type application/json, got %q", ct)
+	}
+
+	if h := rr.Header().Get("FOO"); h != "BAR" {
+		t.Errorf("expected custom header FOO to be BAR, got %q", h)
+	}
+}
+
+func TestTools_WriteJSON_MarshalError(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	err := testTools.WriteJSON(rr, http.StatusCreated, make(chan int))
+	if err == nil {
+		t.Error("expected an error when marshaling a channel, got nil")
+	}
+
+	if rr.Body.Len() != 0 {
+		t.Errorf("expected nothing written on marshal error, got %q", rr.Body.String())
+	}
+
+	if rr.Header().Get("Content-Type") != "" {
+		t.Error("headers should not be set when marshaling fails")
+	}
+}
+
+func TestTools_WriteJSONCached(t *testing.T) {
+	var testTools Tools
+	payload := map[string]int{"id": 1}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := testTools.WriteJSONCached(rr, req, http.StatusOK, payload); err != nil {
+		t.Fatalf("failed to write JSON: %v", err)
+	}
+
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected an ETag header to be set")
+	}
+
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"id":1}` {
+		t.Errorf("expected status 200 with the JSON body, got %d with %q", rr.Code, rr.Body.String())
+	}
+
+	var tests = []struct {
+		name         string
+		method       string
+		ifNoneMatch  string
+		expectedCode int
+	}{
+		{"matching etag", http.MethodGet, etag, http.StatusNotModified},
+		{"weak matching etag in a list", http.MethodGet, `"other", W/` + etag, http.StatusNotModified},
+		{"wildcard", http.MethodHead, "*", http.StatusNotModified},
+		{"stale etag", http.MethodGet, `"stale"`, http.StatusOK},
+		{"not a GET request", http.MethodPost, etag, http.StatusOK},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(e.method, "/", nil)
+			req.Header.Set("If-None-Match", e.ifNoneMatch)
+
+			if err := testTools.WriteJSONCached(rr, req, http.StatusOK, payload); err != nil {
+				t.Fatalf("failed to write JSON: %v", err)
+			}
+
+			if rr.Code != e.expectedCode {
+				t.Errorf("expected status %d, got %d", e.expectedCode, rr.Code)
+			}
+
+			if rr.Header().Get("ETag") != etag {
+				t.Errorf("expected ETag %s, got %s", etag, rr.Header().Get("ETag"))
+			}
+
+			if e.expectedCode == http.StatusNotModified && rr.Body.Len() != 0 {
+				t.Errorf("expected no body with 304, got %q", rr.Body.String())
+			}
+		})
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestTools_EncodeJSON(t *testing.T) {
+	var testTools Tools
+
+	var buf bytes.Buffer
+	if err := testTools.EncodeJSON(&buf, map[string]int{"id": 1}); err != nil {
+		t.Fatalf("failed to encode JSON: %v", err)
+	}
+
+	expected := `{"id":1}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+
+	if err := testTools.EncodeJSON(failingWriter{}, map[string]int{"id": 1}); err == nil || err.Error() != "write failed" {
+		t.Errorf("expected the writer's error, got %v", err)
+	}
+
+	if err := testTools.EncodeJSON(&buf, make(chan int)); err == nil {
+		t.Error("expected an error when encoding a channel, got nil")
+	}
+}
+
+func TestTools_WriteJSONOK(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	if err := testTools.WriteJSONOK(rr, map[string]int{"id": 1}); err != nil {
+		t.Fatalf("failed to write JSON: %v", err)
+	}
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", rr.Code)
+	}
+
+	expected := `{"error":false,"message":"","data":{"id":1}}`
+	if rr.Body.String() != expected {
+		t.Errorf("expected body %s, got %s", expected, rr.Body.String())
+	}
+}
+
+func TestTools_WriteJSONWithMeta(t *testing.T) {
+	var testTools Tools
+
+	var tests = []struct {
+		name     string
+		meta     interface{}
+		expected string
+	}{
+		{"with meta", map[string]int{"page": 2, "total": 40}, `{"error":false,"message":"","data":[1,2],"meta":{"page":2,"total":40}}`},
+		{"nil meta is omitted", nil, `{"error":false,"message":"","data":[1,2]}`},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			if err := testTools.WriteJSONWithMeta(rr, http.StatusOK, []int{1, 2}, e.meta); err != nil {
+				t.Fatalf("failed to write JSON: %v", err)
+			}
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("expected status 200, got %d", rr.Code)
+			}
+
+			if rr.Body.String() != e.expected {
+				t.Errorf("expected body %s, got %s", e.expected, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestTools_Paginate(t *testing.T) {
+	var testTools Tools
+
+	var tests = []struct {
+		name               string
+		page               int
+		perPage            int
+		totalItems         int
+		expectedOffset     int
+		expectedLimit      int
+		expectedTotalPages int
+	}{
+		{"first page", 1, 10, 95, 0, 10, 10},
+		{"middle page", 3, 10, 95, 20, 10, 10},
+		{"last partial page", 10, 10, 95, 90, 10, 10},
+		{"page after the last is clamped", 50, 10, 95, 90, 10, 10},
+		{"page zero is clamped", 0, 10, 95, 0, 10, 10},
+		{"negative page is clamped", -4, 10, 95, 0, 10, 10},
+		{"zero perPage uses default", 2, 0, 95, 20, 20, 5},
+		{"negative perPage uses default", 1, -1, 95, 0, 20, 5},
+		{"no items", 3, 10, 0, 0, 10, 0},
+		{"exact multiple", 2, 25, 50, 25, 25, 2},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			offset, limit, totalPages := testTools.Paginate(e.page, e.perPage, e.totalItems)
+
+			if offset != e.expectedOffset || limit != e.expectedLimit || totalPages != e.expectedTotalPages {
+				t.Errorf("expected offset %d, limit %d and %d pages, got %d, %d and %d",
+					e.expectedOffset, e.expectedLimit, e.expectedTotalPages, offset, limit, totalPages)
+			}
+		})
+	}
+}
+
+func TestTools_WriteJSONError(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	if err := testTools.WriteJSONError(rr, http.StatusNotFound, "not found"); err != nil {
+		t.Fatalf("failed to write JSON: %v", err)
+	}
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", rr.Code)
+	}
+
+	expected := `{"error":true,"message":"not found"}`
+	if rr.Body.String() != expected {
+		t.Errorf("expected body %s, got %s", expected, rr.Body.String())
+	}
+}
+
+type xmlBook struct {
+	XMLName xml.Name `xml:"book"`
+	ID      int      `xml:"id,attr"`
+	Title   string   `xml:"title"`
+}
+
+func TestTools_WriteXML(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	headers := make(http.Header)
+	headers.Add("FOO", "BAR")
+
+	err := testTools.WriteXML(rr, http.StatusCreated, xmlBook{ID: 7, Title: "Go & XML"}, headers)
+	if err != nil {
+		t.Fatalf("failed to write XML: %v", err)
+	}
+
+	expected := xml.Header + `<book id="7"><title>Go &amp; XML</title></book>`
+	if rr.Body.String() != expected {
+		t.Errorf("expected body %s, got %s", expected, rr.Body.String())
+	}
+
+	if rr.Code != http.StatusCreated {
+		t.Errorf("expected status 201, got %d", rr.Code)
+	}
+
+	if ct := rr.Header().Get("Content-Type"); ct != "application/xml" {
+		t.Errorf("expected Content-Type application/xml, got %q", ct)
+	}
+
+	if h := rr.Header().Get("FOO"); h != "BAR" {
+		t.Errorf("expected custom header FOO to be BAR, got %q", h)
+	}
+}
+
+func TestTools_WriteXML_MarshalError(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	if err := testTools.WriteXML(rr, http.StatusOK, make(chan int)); err == nil {
+		t.Error("expected an error when marshaling a channel, got nil")
+	}
+
+	if rr.Body.Len() != 0 {
+		t.Errorf("expected nothing written on marshal error, got %q", rr.Body.String())
+	}
+}
+
+func TestTools_ReadXML(t *testing.T) {
+	var tests = []struct {
+		name         string
+		body         string
+		maxSize      int
+		expectsError bool
+		errorMsg     string
+	}{
+		{"valid xml", `<book id="7"><title>Go</title></book>`, 0, false, ""},
+		{"malformed xml", `<book id="7"><title>Go</book>`, 0, true, "badly-formed XML"},
+		{"truncated xml", `<book id="7"><title>Go`, 0, true, "badly-formed XML"},
+		{"empty body", ``, 0, true, "body must not be empty"},
+		{"oversized body", `<book id="7"><title>` + strings.Repeat("a", 100) + `</title></book>`, 50, true, "body must not be larger than 50 bytes"},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			testTools := Tools{MaxXMLSize: e.maxSize}
+
+			req := httptest.NewRequest("POST", "/", strings.NewReader(e.body))
+			rr := httptest.NewRecorder()
+
+			var book xmlBook
+			err := testTools.ReadXML(rr, req, &book)
+
+			if e.expectsError {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				if !strings.Contains(err.Error(), e.errorMsg) {
+					t.Errorf("expected error containing %q, got %q", e.errorMsg, err.Error())
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if book.ID != 7 || book.Title != "Go" {
+				t.Errorf("unexpected decoded value: %+v", book)
+			}
+		})
+	}
+}
+
+func TestTools_WriteJSONP(t *testing.T) {
+	var testTools Tools
+
+	var tests = []struct {
+		name         string
+		callback     string
+		expectsError bool
+		expectedBody string
+	}{
+		{"simple callback", "cb", false, `cb({"id":1})`},
+		{"dotted callback", "app.handlers.cb_2", false, `app.handlers.cb_2({"id":1})`},
+		{"dollar callback", "$jsonp", false, `$jsonp({"id":1})`},
+		{"script injection", "alert(1);cb", true, ""},
+		{"html injection", "<script>", true, ""},
+		{"leading digit", "1cb", true, ""},
+		{"empty callback", "", true, ""},
+		{"trailing dot", "cb.", true, ""},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			err := testTools.WriteJSONP(rr, http.StatusOK, map[string]int{"id": 1}, e.callback)
+
+			if e.expectsError {
+				if err == nil {
+					t.Error("expected an error for an unsafe callback, got nil")
+				}
+				if rr.Body.Len() != 0 {
+					t.Errorf("expected nothing written for an unsafe callback, got %q", rr.Body.String())
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if rr.Body.String() != e.expectedBody {
+				t.Errorf("expected body %s, got %s", e.expectedBody, rr.Body.String())
+			}
+
+			if ct := rr.Header().Get("Content-Type"); ct != "application/javascript" {
+				t.Errorf("expected Content-Type application/javascript, got %q", ct)
+			}
+		})
+	}
+}
+
+func TestTools_ErrorJSON(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	err := testTools.ErrorJSON(rr, errors.New("service unavailable"), http.StatusServiceUnavailable)
+	if err != nil {
+		t.Errorf("error not expected: %s", err)
+	}
+
+	var payload JSONResponse
+	err = json.NewDecoder(rr.Body).Decode(&payload)
+	if err != nil {
+		t.Error("received error when decoding JSON", err)
+	}
+
+	if !payload.Error {
+		t.Error("error set to false in JSON, and it should be true")
+	}
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 and got %d", rr.Code)
+	}
+}
+
+func TestTools_ErrorJSON_Status(t *testing.T) {
+	var testTools Tools
+
+	testCases := []struct {
+		name           string
+		status         []int
+		expectedStatus int
+	}{
+		{"default status", nil, http.StatusBadRequest},
+		{"not found override", []int{http.StatusNotFound}, http.StatusNotFound},
+		{"unprocessable entity override", []int{http.StatusUnprocessableEntity}, http.StatusUnprocessableEntity},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			if err := testTools.ErrorJSON(rr, errors.New("some error"), tc.status...); err != nil {
+				t.Fatalf("error not expected: %s", err)
+			}
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+
+			if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("expected Content-Type application/json, got %q", ct)
+			}
+
+			var payload map[string]interface{}
+			if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+				t.Fatalf("received error when decoding JSON: %v", err)
+			}
+
+			if payload["error"] != true || payload["message"] != "some error" {
+				t.Errorf("unexpected payload: %+v", payload)
+			}
+
+			if _, ok := payload["data"]; ok {
+				t.Errorf("expected no data key, got %+v", payload)
+			}
+		})
+	}
+}
+
+type RoundTripFunc func(*http.Request) *http.Response
+
+func (f RoundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req), nil
+}
+
+func NewtestClient(fn RoundTripFunc) *http.Client {
+	return &http.Client{
+		Transport: fn,
+	}
+}
+
+func TestTools_PushJSONToRemote(t *testing.T) {
+	client := NewtestClient(func(req *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewBufferString("ok")),
+			Header:     make(http.Header),
+		}
+	})
+
+	var testTools Tools
+	var foo struct {
+		Bar string `json:"bar"`
+	}
+	foo.Bar = "bar"
+
+	_, _, err := testTools.PushJSONToRemote("http://example.com/some/path", foo, client)
+	if err != nil {
+		t.Error("failed to call remote url:", err)
+	}
+}
+
+func TestTools_PushJSON(t *testing.T) {
+	t.Run("successful round trip", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				t.Errorf("expected POST, got %s", r.Method)
+			}
+
+			if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("expected Content-Type application/json, got %q", ct)
+			}
+
+			if h := r.Header.Get("X-Foo"); h != "bar" {
+				t.Errorf("expected X-Foo header to be bar, got %q", h)
+			}
+
+			var payload struct {
+				Bar string `json:"bar"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				t.Errorf("failed to decode pushed JSON: %v", err)
+			}
+
+			if payload.Bar != "baz" {
+				t.Errorf("expected bar to be baz, got %q", payload.Bar)
+			}
+
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer srv.Close()
+
+		testTools := Tools{HTTPClient: srv.Client()}
+
+		headers := make(http.Header)
+		headers.Set("X-Foo", "bar")
+
+		resp, status, err := testTools.PushJSON(context.Background(), srv.URL, map[string]string{"bar": "baz"}, headers)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if status != http.StatusOK {
+			t.Errorf("expected status 200, got %d", status)
+		}
+	})
+
+	t.Run("network error", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		url := srv.URL
+		srv.Close()
+
+		var testTools Tools
+		resp, status, err := testTools.PushJSON(context.Background(), url, map[string]string{"bar": "baz"})
+		if err == nil {
+			t.Error("expected a network error, got nil")
+		}
+
+		if resp != nil || status != 0 {
+			t.Errorf("expected nil response and status 0, got %v and %d", resp, status)
+		}
+	})
+}
+
+func TestTools_PushJSONWithRetry(t *testing.T) {
+	t.Run("succeeds after failures", func(t *testing.T) {
+		var attempts atomic.Int64
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if attempts.Add(1) <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer srv.Close()
+
+		testTools := Tools{HTTPClient: srv.Client()}
+
+		resp, status, err := testTools.PushJSONWithRetry(context.Background(), srv.URL, map[string]string{"bar": "baz"}, 5, time.Millisecond)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if status != http.StatusCreated {
+			t.Errorf("expected status 201, got %d", status)
+		}
+
+		if n := attempts.Load(); n != 3 {
+			t.Errorf("expected 3 attempts, got %d", n)
+		}
+	})
+
+	t.Run("gives up after the last attempt", func(t *testing.T) {
+		var attempts atomic.Int64
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer srv.Close()
+
+		testTools := Tools{HTTPClient: srv.Client()}
+
+		resp, status, err := testTools.PushJSONWithRetry(context.Background(), srv.URL, nil, 3, time.Millisecond)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if status != http.StatusBadGateway {
+			t.Errorf("expected status 502, got %d", status)
+		}
+
+		if n := attempts.Load(); n != 3 {
+			t.Errorf("expected 3 attempts, got %d", n)
+		}
+	})
+
+	t.Run("does not retry client errors", func(t *testing.T) {
+		var attempts atomic.Int64
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer srv.Close()
+
+		testTools := Tools{HTTPClient: srv.Client()}
+
+		resp, status, err := testTools.PushJSONWithRetry(context.Background(), srv.URL, nil, 3, time.Millisecond)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if status != http.StatusBadRequest || attempts.Load() != 1 {
+			t.Errorf("expected a single attempt with status 400, got %d attempts and status %d", attempts.Load(), status)
+		}
+	})
+
+	t.Run("retries network errors", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		url := srv.URL
+		srv.Close()
+
+		var testTools Tools
+		_, _, err := testTools.PushJSONWithRetry(context.Background(), url, nil, 2, time.Millisecond)
+		if err == nil {
+			t.Error("expected a network error, got nil")
+		}
+	})
+
+	t.Run("context canceled after a response", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		body := &bufferCloser{}
+		testTools := Tools{HTTPClient: NewtestClient(func(req *http.Request) *http.Response {
+			cancel()
+			return &http.Response{StatusCode: http.StatusOK, Body: body, Header: make(http.Header)}
+		})}
+
+		response, _, err := testTools.PushJSONWithRetry(ctx, "http://example.com", nil, 3, time.Millisecond)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+
+		if response != nil {
+			t.Error("expected no response once the context is canceled")
+		}
+
+		if !body.closed {
+			t.Error("expected the discarded response body to be closed")
+		}
+	})
+
+	t.Run("context canceled while waiting", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer srv.Close()
+
+		testTools := Tools{HTTPClient: srv.Client()}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, _, err := testTools.PushJSONWithRetry(ctx, srv.URL, nil, 5, time.Hour)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, got %v", err)
+		}
+
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("expected to stop waiting once the context is done, took %v", elapsed)
+		}
+	})
+}
+
+func TestTools_BasicAuth(t *testing.T) {
+	var testTools Tools
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := testTools.BasicAuth(next, "admin", "secret", "admin area")
+
+	testCases := []struct {
+		name           string
+		setAuth        bool
+		username       string
+		password       string
+		expectedStatus int
+	}{
+		{"valid credentials", true, "admin", "secret", http.StatusOK},
+		{"wrong password", true, "admin", "wrong", http.StatusUnauthorized},
+		{"wrong username", true, "root", "secret", http.StatusUnauthorized},
+		{"missing credentials", false, "", "", http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/admin", nil)
+			if tc.setAuth {
+				req.SetBasicAuth(tc.username, tc.password)
+			}
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+
+			challenge := rr.Header().Get("WWW-Authenticate")
+			if tc.expectedStatus == http.StatusUnauthorized && !strings.Contains(challenge, `Basic realm="admin area"`) {
+				t.Errorf("expected WWW-Authenticate challenge for the realm, got %q", challenge)
+			}
+
+			if tc.expectedStatus == http.StatusOK && challenge != "" {
+				t.Errorf("expected no WWW-Authenticate header, got %q", challenge)
+			}
+		})
+	}
+}
+
+func TestTools_MaxBytes(t *testing.T) {
+	var testTools Tools
+
+	testCases := []struct {
+		name         string
+		body         string
+		expectsError bool
+	}{
+		{"body within limit", "0123456789", false},
+		{"oversized body", "0123456789abcdef", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var readErr error
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, readErr = io.ReadAll(r.Body)
+			})
+
+			req := httptest.NewRequest("POST", "/", bytes.NewBufferString(tc.body))
+			testTools.MaxBytes(next, 10).ServeHTTP(httptest.NewRecorder(), req)
+
+			var maxBytesError *http.MaxBytesError
+			if tc.expectsError && !errors.As(readErr, &maxBytesError) {
+				t.Errorf("expected a *http.MaxBytesError from downstream read, got %v", readErr)
+			}
+
+			if !tc.expectsError && readErr != nil {
+				t.Errorf("unexpected read error: %v", readErr)
+			}
+		})
+	}
+}
+
+func TestTools_AllowMethods(t *testing.T) {
+	var testTools Tools
+
+	testCases := []struct {
+		name         string
+		method       string
+		expectedCode int
+		nextCalled   bool
+	}{
+		{"allowed method", "GET", http.StatusOK, true},
+		{"other allowed method", "POST", http.StatusOK, true},
+		{"disallowed method", "DELETE", http.StatusMethodNotAllowed, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			nextCalled := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextCalled = true
+			})
+
+			rr := httptest.NewRecorder()
+			testTools.AllowMethods(next, "GET", "POST").ServeHTTP(rr, httptest.NewRequest(tc.method, "/", nil))
+
+			if rr.Code != tc.expectedCode {
+				t.Errorf("expected status %d, got %d", tc.expectedCode, rr.Code)
+			}
+
+			if nextCalled != tc.nextCalled {
+				t.Errorf("expected next called to be %v, got %v", tc.nextCalled, nextCalled)
+			}
+
+			allow := rr.Header().Get("Allow")
+			if tc.nextCalled && allow != "" {
+				t.Errorf("expected no Allow header, got %q", allow)
+			}
+			if !tc.nextCalled && allow != "GET, POST" {
+				t.Errorf("expected Allow header %q, got %q", "GET, POST", allow)
+			}
+		})
+	}
+}
+
+func TestTools_CORS(t *testing.T) {
+	var testTools Tools
+
+	nextCalled := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nextCalled = true
+		w.WriteHeader(http.StatusOK)
+	})
+
+	handler := testTools.CORS(next, CORSOptions{
+		AllowedOrigins:   []string{"https://example.com"},
+		AllowedMethods:   []string{"GET", "PUT"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowCredentials: true,
+	})
+
+	t.Run("preflight request", func(t *testing.T) {
+		nextCalled = false
+		req := httptest.NewRequest("OPTIONS", "/", nil)
+		req.Header.Set("Origin", "https://example.com")
+		req.Header.Set("Access-Control-Request-Method", "PUT")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNoContent {
+			t.Errorf("expected status 204, got %d", rr.Code)
+		}
+
+		if nextCalled {
+			t.Error("preflight should not reach the next handler")
+		}
+
+		expectedHeaders := map[string]string{
+			"Access-Control-Allow-Origin":      "https://example.com",
+			"Access-Control-Allow-Methods":     "GET, PUT",
+			"Access-Control-Allow-Headers":     "Content-Type, Authorization",
+			"Access-Control-Allow-Credentials": "true",
+		}
+		for header, expected := range expectedHeaders {
+			if got := rr.Header().Get(header); got != expected {
+				t.Errorf("expected %s to be %q, got %q", header, expected, got)
+			}
+		}
+	})
+
+	t.Run("simple request", func(t *testing.T) {
+		nextCalled = false
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Origin", "https://example.com")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if !nextCalled || rr.Code != http.StatusOK {
+			t.Errorf("expected the next handler to answer with 200, got %d", rr.Code)
+		}
+
+		if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "https://example.com" {
+			t.Errorf("expected allowed origin header, got %q", got)
+		}
+
+		if got := rr.Header().Get("Access-Control-Allow-Methods"); got != "" {
+			t.Errorf("expected no Allow-Methods header on simple requests, got %q", got)
+		}
+	})
+
+	t.Run("disallowed origin", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Origin", "https://evil.com")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("expected no CORS headers for a disallowed origin, got %q", got)
+		}
+	})
+
+	t.Run("wildcard origin", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Origin", "https://anything.com")
+		rr := httptest.NewRecorder()
+
+		testTools.CORS(next, CORSOptions{AllowedOrigins: []string{"*"}}).ServeHTTP(rr, req)
+
+		if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+			t.Errorf("expected wildcard origin header, got %q", got)
+		}
+	})
+
+	t.Run("wildcard origin with credentials", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected CORS to panic when combining a wildcard origin with credentials")
+			}
 		}()
 
-		// Give the server a moment to start
-		time.Sleep(100 * time.Millisecond)
+		testTools.CORS(next, CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+	})
+}
 
-		// Trigger shutdown via context
-		cancel()
+func TestTools_RequestID(t *testing.T) {
+	var testTools Tools
 
-		select {
-		case err := <-errChan:
-			if err != nil {
-				t.Errorf("expected nil error on graceful shutdown, got %v", err)
+	var ctxID string
+	var ctxOK bool
+	handler := testTools.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctxID, ctxOK = RequestIDFromContext(r.Context())
+	}))
+
+	t.Run("generates an ID", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+		id := rr.Header().Get("X-Request-ID")
+		if id == "" {
+			t.Fatal("expected a generated X-Request-ID header")
+		}
+
+		if !ctxOK || ctxID != id {
+			t.Errorf("expected context ID %q to match the header, got %q (found: %v)", id, ctxID, ctxOK)
+		}
+
+		rr2 := httptest.NewRecorder()
+		handler.ServeHTTP(rr2, httptest.NewRequest("GET", "/", nil))
+		if rr2.Header().Get("X-Request-ID") == id {
+			t.Error("expected different IDs for different requests")
+		}
+	})
+
+	t.Run("reuses the incoming ID", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Request-ID", "incoming-id")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if got := rr.Header().Get("X-Request-ID"); got != "incoming-id" {
+			t.Errorf("expected incoming ID to be passed through, got %q", got)
+		}
+
+		if ctxID != "incoming-id" {
+			t.Errorf("expected incoming ID in context, got %q", ctxID)
+		}
+	})
+
+	t.Run("rejects unsafe incoming IDs", func(t *testing.T) {
+		for _, incoming := range []string{
+			strings.Repeat("a", 129),
+			"forged\nlevel=ERROR msg=injected",
+			"with spaces",
+			"\x1b[31mred",
+			"non-ascii-é",
+		} {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Request-ID", incoming)
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			got := rr.Header().Get("X-Request-ID")
+			if got == incoming || got == "" {
+				t.Errorf("expected %q to be replaced by a generated ID, got %q", incoming, got)
 			}
-		case <-time.After(5 * time.Second):
-			t.Error("server did not shut down within timeout")
+
+			if ctxID != got {
+				t.Errorf("expected context ID %q to match the header, got %q", got, ctxID)
+			}
+		}
+	})
+
+	t.Run("missing from context", func(t *testing.T) {
+		if id, ok := RequestIDFromContext(context.Background()); ok || id != "" {
+			t.Errorf("expected no request ID, got %q", id)
 		}
 	})
+}
+
+func TestTools_RateLimit(t *testing.T) {
+	var testTools Tools
+
+	handler := testTools.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), 3)
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i := 1; i <= 3; i++ {
+		if rr := request("10.0.0.1:1234"); rr.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status 200, got %d", i, rr.Code)
+		}
+	}
+
+	rr := request("10.0.0.1:5678")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429 once the limit is exhausted, got %d", rr.Code)
+	}
+
+	retryAfter, err := strconv.Atoi(rr.Header().Get("Retry-After"))
+	if err != nil || retryAfter <= 0 || retryAfter > 60 {
+		t.Errorf("expected Retry-After between 1 and 60 seconds, got %q", rr.Header().Get("Retry-After"))
+	}
+
+	if rr := request("10.0.0.2:1234"); rr.Code != http.StatusOK {
+		t.Errorf("expected another IP to be unaffected, got status %d", rr.Code)
+	}
 
-	t.Run("Server Port Conflict", func(t *testing.T) {
-		// Start a dummy listener on a port
-		srv1 := &http.Server{Addr: "localhost:8082"}
-		go srv1.ListenAndServe()
-		defer srv1.Close()
+	for _, perMinute := range []int{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected RateLimit to panic for %d requests per minute", perMinute)
+				}
+			}()
 
-		time.Sleep(100 * time.Millisecond)
+			testTools.RateLimit(http.NotFoundHandler(), perMinute)
+		}()
+	}
+}
 
-		// Try to start our server on the same port
-		srv2 := &http.Server{Addr: "localhost:8082"}
-		ctx := context.Background()
+func TestTools_NewTokenBucket(t *testing.T) {
+	var testTools Tools
 
-		err := tools.RunServer(ctx, srv2, 1*time.Second)
-		if err == nil {
-			t.Error("expected an error due to port conflict, got nil")
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	bucket := testTools.NewTokenBucket(2, 3)
+	bucket.now = func() time.Time { return now }
+
+	for i := range 3 {
+		if !bucket.Allow() {
+			t.Fatalf("expected burst request %d to be allowed", i+1)
 		}
-	})
+	}
 
-	t.Run("Graceful Shutdown via Signal Agnostic", func(t *testing.T) {
-		tools := &Tools{}
+	if bucket.Allow() {
+		t.Error("expected request to be denied once the burst is consumed")
+	}
 
-		testChan := make(chan os.Signal, 1)
-		tools.signalChan = testChan
+	now = now.Add(250 * time.Millisecond)
+	if bucket.Allow() {
+		t.Error("expected request to be denied before a full token is refilled")
+	}
 
-		srv := &http.Server{Addr: "localhost:0"}
-		errChan := make(chan error, 1)
+	now = now.Add(250 * time.Millisecond)
+	if !bucket.Allow() {
+		t.Error("expected request to be allowed after a token is refilled")
+	}
 
-		go func() {
-			errChan <- tools.RunServer(context.Background(), srv, 2*time.Second)
-		}()
+	now = now.Add(time.Hour)
+	allowed := 0
+	for range 10 {
+		if bucket.Allow() {
+			allowed++
+		}
+	}
 
-		time.Sleep(100 * time.Millisecond)
+	if allowed != 3 {
+		t.Errorf("expected refill to be capped at the burst of 3, got %d", allowed)
+	}
+}
 
-		testChan <- os.Interrupt
+func TestTools_NewTokenBucket_Concurrent(t *testing.T) {
+	var testTools Tools
+	bucket := testTools.NewTokenBucket(0, 50)
 
-		select {
-		case err := <-errChan:
-			if err != nil {
-				t.Errorf("expected nil error, got %v", err)
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if bucket.Allow() {
+				allowed.Add(1)
 			}
-		case <-time.After(2 * time.Second):
-			t.Error("server did not respond to injected signal")
-		}
-	})
+		}()
+	}
+	wg.Wait()
+
+	if allowed.Load() != 50 {
+		t.Errorf("expected exactly 50 requests to be allowed, got %d", allowed.Load())
+	}
 }
 
-func TestTools_ReadJSON(t *testing.T) {
-	tools := &Tools{}
+func TestTools_Gzip(t *testing.T) {
+	var testTools Tools
 
-	// Define a dummy struct for testing
-	type Person struct {
-		Name string `json:"name"`
-		Age  int    `json:"age"`
-	}
+	large := strings.Repeat(`{"message":"hello world"},`, 200)
 
-	// Table-driven tests
 	testCases := []struct {
-		name          string
-		json          string
-		maxSize       int
-		allowUnknown  bool
-		expectError   bool
-		errorContains string
+		name             string
+		acceptEncoding   string
+		body             string
+		contentType      string
+		expectCompressed bool
 	}{
-		{
-			name:        "Valid JSON",
-			json:        `{"name": "Jack", "age": 30}`,
-			expectError: false,
-		},
-		{
-			name:          "Malformed JSON",
-			json:          `{"name": "Jack", "age": 30`, // missing closing brace
-			expectError:   true,
-			errorContains: "badly-formed JSON",
-		},
-		{
-			name:          "Incorrect Type",
-			json:          `{"name": "Jack", "age": "thirty"}`, // age should be int
-			expectError:   true,
-			errorContains: "incorrect JSON type",
-		},
-		{
-			name:          "Empty Body",
-			json:          ``,
-			expectError:   true,
-			errorContains: "body must not be empty",
-		},
-		{
-			name:          "Unknown Field (Disallowed)",
-			json:          `{"name": "Jack", "age": 30, "height": 180}`,
-			allowUnknown:  false,
-			expectError:   true,
-			errorContains: "unknown key",
-		},
-		{
-			name:         "Unknown Field (Allowed)",
-			json:         `{"name": "Jack", "age": 30, "height": 180}`,
-			allowUnknown: true,
-			expectError:  false,
-		},
-		{
-			name:          "Multiple JSON Values",
-			json:          `{"name": "Jack"}{"name": "Jill"}`,
-			expectError:   true,
-			errorContains: "only one JSON value",
-		},
-		{
-			name:          "Body Too Large",
-			json:          `{"name": "Jack", "age": 30}`,
-			maxSize:       5, // extremely small limit
-			expectError:   true,
-			errorContains: "larger than",
-		},
+		{"gzip capable client", "gzip, deflate", large, "application/json", true},
+		{"client without gzip", "deflate", large, "application/json", false},
+		{"gzip explicitly refused", "gzip;q=0", large, "application/json", false},
+		{"small response", "gzip", `{"message":"hi"}`, "application/json", false},
+		{"already compressed type", "gzip", large, "image/png", false},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
+			handler := testTools.Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tc.contentType)
+				w.WriteHeader(http.StatusCreated)
+				_, _ = io.WriteString(w, tc.body)
+			}))
 
-			tools.MaxJSONSize = tc.maxSize
-			tools.AllowUnknownFields = tc.allowUnknown
-
-			// Create request
-			req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(tc.json)))
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding)
 			rr := httptest.NewRecorder()
 
-			var data Person
-			err := tools.ReadJSON(rr, req, &data)
+			handler.ServeHTTP(rr, req)
 
-			if tc.expectError {
-				if err == nil {
-					t.Errorf("%s: expected an error but got nil", tc.name)
-				}
+			if rr.Code != http.StatusCreated {
+				t.Errorf("expected status 201, got %d", rr.Code)
+			}
 
-				if err != nil && tc.errorContains != "" {
-					if !contains(err.Error(), tc.errorContains) {
-						t.Errorf("%s: expected error to contain %q, got %q", tc.name, tc.errorContains, err.Error())
-					}
+			compressed := rr.Header().Get("Content-Encoding") == "gzip"
+			if compressed != tc.expectCompressed {
+				t.Fatalf("expected compressed to be %v, got %v", tc.expectCompressed, compressed)
+			}
+
+			body := rr.Body.Bytes()
+			if compressed {
+				zr, err := gzip.NewReader(rr.Body)
+				if err != nil {
+					t.Fatalf("invalid gzip body: %v", err)
 				}
-			} else {
+
+				body, err = io.ReadAll(zr)
 				if err != nil {
-					t.Errorf("%s: expected no error but got %v", tc.name, err)
+					t.Fatalf("failed to decompress body: %v", err)
 				}
 			}
+
+			if string(body) != tc.body {
+				t.Errorf("body does not match the handler output")
+			}
 		})
 	}
 }
 
-// Helper to check for substrings in errors
-func contains(s, substr string) bool {
-	return bytes.Contains([]byte(s), []byte(substr))
+func TestTools_Gzip_Range(t *testing.T) {
+	var testTools Tools
+
+	dir := t.TempDir()
+	content := strings.Repeat("0123456789", 1000)
+	if err := os.WriteFile(filepath.Join(dir, "data.txt"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := testTools.Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeFile(w, r, filepath.Join(dir, "data.txt"))
+	}))
+
+	t.Run("range request is not compressed", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/data.txt", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("Range", "bytes=0-4999")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusPartialContent {
+			t.Fatalf("expected status 206, got %d", rr.Code)
+		}
+
+		if ce := rr.Header().Get("Content-Encoding"); ce != "" {
+			t.Errorf("expected no Content-Encoding on a partial response, got %q", ce)
+		}
+
+		if rr.Body.String() != content[:5000] {
+			t.Error("expected the requested range, uncompressed")
+		}
+
+		if etag := rr.Header().Get("ETag"); etag != `"v1"` {
+			t.Errorf("expected the strong ETag to be kept, got %q", etag)
+		}
+	})
+
+	t.Run("compressed response gets a weak etag", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/data.txt", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if ce := rr.Header().Get("Content-Encoding"); ce != "gzip" {
+			t.Fatalf("expected a gzip response, got %q", ce)
+		}
+
+		if etag := rr.Header().Get("ETag"); etag != `W/"v1"` {
+			t.Errorf("expected a weak ETag, got %q", etag)
+		}
+	})
 }
 
-func TestTools_WriteJSON(t *testing.T) {
+func TestTools_Gzip_ResponseController(t *testing.T) {
 	var testTools Tools
 
-	rr := httptest.NewRecorder()
-	payload := &JSONResponse{
-		Error:   false,
-		Message: "foo",
-	}
+	srv := httptest.NewServer(testTools.Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
 
-	headers := make(http.Header)
-	headers.Add("FOO", "BAR")
+		if err := rc.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			http.Error(w, "SetReadDeadline: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-	err := testTools.WriteJSON(rr, http.StatusOK, payload, headers)
+		if err := rc.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+			http.Error(w, "SetWriteDeadline: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		_, _ = io.WriteString(w, "ok")
+		if err := rc.Flush(); err != nil {
+			t.Errorf("unexpected Flush error: %v", err)
+		}
+	})))
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL, nil)
 	if err != nil {
-		t.Errorf("failed to write JSON: %v", err)
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Errorf("expected status 200, got %d: %s", resp.StatusCode, body)
 	}
 }
 
-func TestTools_ErrorJSON(t *testing.T) {
-	var testTools Tools
+func TestTools_RecoverJSON(t *testing.T) {
+	logs := new(bytes.Buffer)
+	testTools := Tools{Logger: slog.New(slog.NewTextHandler(logs, nil))}
+
+	handler := testTools.RecoverJSON(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("something went wrong")
+	}))
 
 	rr := httptest.NewRecorder()
-	err := testTools.ErrorJSON(rr, errors.New("service unavailable"), http.StatusServiceUnavailable)
-	if err != nil {
-		t.Errorf("error not expected: %s", err)
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/boom", nil))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", rr.Code)
 	}
 
 	var payload JSONResponse
-	err = json.NewDecoder(rr.Body).Decode(&payload)
-	if err != nil {
-		t.Error("received error when decoding JSON", err)
+	if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+		t.Fatalf("expected a JSON body: %v", err)
 	}
 
-	if !payload.Error {
-		t.Error("error set to false in JSON, and it should be true")
+	if !payload.Error || payload.Message != "Internal Server Error" {
+		t.Errorf("unexpected payload: %+v", payload)
 	}
 
-	if rr.Code != http.StatusServiceUnavailable {
-		t.Errorf("expected 503 and got %d", rr.Code)
+	if !contains(logs.String(), "something went wrong") || !contains(logs.String(), "stack=") {
+		t.Errorf("expected the panic and its stack to be logged, got %q", logs.String())
 	}
-}
 
-type RoundTripFunc func(*http.Request) *http.Response
+	rr = httptest.NewRecorder()
+	testTools.RecoverJSON(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
 
-func (f RoundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
-	return f(req), nil
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected handlers that don't panic to be untouched, got status %d", rr.Code)
+	}
 }
 
-func NewtestClient(fn RoundTripFunc) *http.Client {
-	return &http.Client{
-		Transport: fn,
+func TestTools_HealthHandler(t *testing.T) {
+	var testTools Tools
+
+	pass := func() error { return nil }
+	fail := func() error { return errors.New("database unreachable") }
+
+	var tests = []struct {
+		name           string
+		checks         []func() error
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"no checks", nil, http.StatusOK, `{"error":false,"message":"ok"}`},
+		{"all checks pass", []func() error{pass, pass}, http.StatusOK, `{"error":false,"message":"ok"}`},
+		{"one check fails", []func() error{pass, fail}, http.StatusServiceUnavailable,
+			`{"error":true,"message":"1 of 2 health checks failed","data":[{"check":2,"error":"database unreachable"}]}`},
 	}
-}
 
-func TestTools_PushJSONToRemote(t *testing.T) {
-	client := NewtestClient(func(req *http.Request) *http.Response {
-		return &http.Response{
-			StatusCode: http.StatusOK,
-			Body:       io.NopCloser(bytes.NewBufferString("ok")),
-			Header:     make(http.Header),
-		}
-	})
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			testTools.HealthHandler(e.checks...).ServeHTTP(rr, httptest.NewRequest("GET", "/health", nil))
+
+			if rr.Code != e.expectedStatus {
+				t.Errorf("expected status %d, got %d", e.expectedStatus, rr.Code)
+			}
+
+			if rr.Body.String() != e.expectedBody {
+				t.Errorf("expected body %s, got %s", e.expectedBody, rr.Body.String())
+			}
+
+			if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("expected Content-Type application/json, got %q", ct)
+			}
+		})
+	}
+}
 
+func TestTools_GetIP(t *testing.T) {
 	var testTools Tools
-	var foo struct {
-		Bar string `json:"bar"`
+
+	trusted := []string{"10.0.0.1", "192.168.0.0/16"}
+
+	testCases := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		realIP       string
+		expectedIP   string
+	}{
+		{"no proxy headers", "203.0.113.7:4321", "", "", "203.0.113.7"},
+		{"untrusted peer ignores headers", "203.0.113.7:4321", "1.2.3.4", "5.6.7.8", "203.0.113.7"},
+		{"trusted proxy with forwarded for", "10.0.0.1:4321", "198.51.100.1", "", "198.51.100.1"},
+		{"trusted proxy chain", "10.0.0.1:4321", "198.51.100.1, 192.168.1.10", "", "198.51.100.1"},
+		{"spoofed entry before the real client", "10.0.0.1:4321", "6.6.6.6, 198.51.100.1, 192.168.1.10", "", "198.51.100.1"},
+		{"trusted proxy with real ip", "192.168.5.5:4321", "", "198.51.100.2", "198.51.100.2"},
+		{"trusted proxy without headers", "10.0.0.1:4321", "", "", "10.0.0.1"},
 	}
-	foo.Bar = "bar"
 
-	_, _, err := testTools.PushJSONToRemote("http://example.com/some/path", foo, client)
-	if err != nil {
-		t.Error("failed to call remote url:", err)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+			}
+			if tc.realIP != "" {
+				req.Header.Set("X-Real-IP", tc.realIP)
+			}
+
+			if ip := testTools.GetIP(req, trusted); ip != tc.expectedIP {
+				t.Errorf("expected IP %s, got %s", tc.expectedIP, ip)
+			}
+		})
 	}
+
+	t.Run("multiple forwarded for lines", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:4321"
+		req.Header.Add("X-Forwarded-For", "6.6.6.6")
+		req.Header.Add("X-Forwarded-For", "1.2.3.4")
+
+		if ip := testTools.GetIP(req, trusted); ip != "1.2.3.4" {
+			t.Errorf("expected IP 1.2.3.4 from the last line, got %s", ip)
+		}
+	})
 }